@@ -1,49 +1,92 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/alcimerio/gopos-ratelimiter/pkg/config"
 	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
-	"github.com/alcimerio/gopos-ratelimiter/pkg/middleware"
 	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
 	"github.com/joho/godotenv"
 )
 
 func main() {
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
+	// Load environment variables, the .env file is optional when a config file is used
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
 		log.Fatal("Error loading .env file")
 	}
 
-	// Parse configuration
-	ipLimit, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_IP"))
-	tokenLimit, _ := strconv.Atoi(os.Getenv("RATE_LIMIT_TOKEN"))
-	blockDuration, _ := strconv.Atoi(os.Getenv("BLOCK_DURATION"))
-	redisHost := os.Getenv("REDIS_HOST")
-	redisPort, _ := strconv.Atoi(os.Getenv("REDIS_PORT"))
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-	redisDB, _ := strconv.Atoi(os.Getenv("REDIS_DB"))
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON policy file")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit")
+	flag.Parse()
 
-	// Initialize Redis storage
-	redisStorage, err := storage.NewRedisStorage(redisHost, redisPort, redisPassword, redisDB)
+	// Parse configuration, environment variables override the policy file
+	file := &config.File{}
+	if *configPath != "" {
+		var err error
+		if file, err = config.Load(*configPath); err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+	}
+
+	// Report every invalid field at once, before connecting to Redis
+	if err := errors.Join(file.ApplyEnv(os.Getenv), file.Validate()); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *checkConfig {
+		log.Print("Configuration is valid")
+		return
+	}
+
+	// Initialize the storage, Redis unless storage.type is memory
+	store, err := file.NewStorage()
 	if err != nil {
-		log.Fatalf("Failed to initialize Redis storage: %v", err)
+		log.Fatalf("Failed to initialize storage: %v", err)
 	}
-	defer redisStorage.Close()
+	defer store.Close()
 
-	// Initialize rate limiter
-	rateLimiter := limiter.NewRateLimiter(redisStorage, limiter.Config{
-		IPLimit:       ipLimit,
-		TokenLimit:    tokenLimit,
-		BlockDuration: time.Duration(blockDuration) * time.Second,
-	})
+	// With Redis, the local failure policy limits requests in memory while Redis
+	// is unavailable
+	var limiterOptions []limiter.Option
+	redisStorage, isRedis := store.(*storage.RedisStorage)
+	if isRedis {
+		fallback := file.NewMemoryStorage()
+		defer fallback.Close()
+		limiterOptions = append(limiterOptions, limiter.WithFallbackStorage(fallback))
+	}
 
-	// Create middleware
-	rateLimiterMiddleware := middleware.NewRateLimiterMiddleware(rateLimiter)
+	// Create the rate limiter and middleware. Policy files are reloaded on SIGHUP,
+	// when they change and when a message is published to the reload channel
+	var rateLimiterMiddleware interface {
+		Handler(next http.Handler) http.Handler
+	}
+	if *configPath != "" {
+		reloader, err := config.NewReloader(*configPath, store, os.Getenv, limiterOptions...)
+		if err != nil {
+			log.Fatalf("Failed to initialize rate limiter: %v", err)
+		}
+
+		ctx := context.Background()
+		go reloader.WatchSignals(ctx, syscall.SIGHUP)
+		if interval := time.Duration(file.Reload.Interval); interval > 0 {
+			go reloader.WatchFile(ctx, interval)
+		}
+		if channel := file.Reload.RedisChannel; channel != "" && isRedis {
+			go reloader.WatchRedis(ctx, redisStorage.Client(), channel)
+		}
+		rateLimiterMiddleware = reloader
+	} else {
+		rateLimiterMiddleware, err = file.NewMiddleware(store, limiterOptions...)
+		if err != nil {
+			log.Fatalf("Failed to initialize rate limiter: %v", err)
+		}
+	}
 
 	// Create a simple handler for testing
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -55,8 +98,8 @@ func main() {
 	http.Handle("/", rateLimiterMiddleware.Handler(handler))
 
 	// Start server
-	log.Printf("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	log.Printf("Server starting on %s", file.Addr())
+	if err := http.ListenAndServe(file.Addr(), nil); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,311 @@
+// Package access implements allowlists and denylists matching requests by client
+// IP or network, token and header, checked before any rate limit
+package access
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Request holds what lists match a request against
+type Request struct {
+	// IP is the client IP address
+	IP string
+
+	// Token is the key identifying the request, such as an API key
+	Token string
+
+	// Header holds the request headers
+	Header http.Header
+}
+
+// List defines the interface for allowlists and denylists
+type List interface {
+	// Contains reports whether a request matches an entry of the list
+	Contains(ctx context.Context, r Request) (bool, error)
+}
+
+// Lists matches requests matching any of its lists, such as entries from a
+// config file together with a Redis set
+type Lists []List
+
+func (l Lists) Contains(ctx context.Context, r Request) (bool, error) {
+	for _, list := range l {
+		matched, err := list.Contains(ctx, r)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// ParseEntry validates an entry of a list and returns it in its canonical form,
+// with the network of CIDRs and the canonical header name. Entries are written as:
+//
+//	ip:10.0.0.0/8                  an IP address or CIDR
+//	token:abc123                   an exact token
+//	header:X-Internal-Service      a header that is present
+//	header:X-Internal-Service=ci   a header with an exact value
+func ParseEntry(entry string) (string, error) {
+	kind, value, _ := strings.Cut(strings.TrimSpace(entry), ":")
+	switch {
+	case kind == "ip" && value != "":
+		network, err := ParseNetwork(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid access list entry %q: %v", entry, err)
+		}
+		if ones, bits := network.Mask.Size(); ones == bits {
+			return "ip:" + network.IP.String(), nil
+		}
+		return "ip:" + network.String(), nil
+	case kind == "token" && value != "":
+		return "token:" + value, nil
+	case kind == "header" && value != "":
+		name, headerValue, hasValue := strings.Cut(value, "=")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			break
+		}
+		if !hasValue {
+			return "header:" + name, nil
+		}
+		return "header:" + name + "=" + headerValue, nil
+	}
+	return "", fmt.Errorf("unsupported access list entry %q, use ip:<address or CIDR>, token:<token> or header:<name>[=<value>]", entry)
+}
+
+// MemoryList keeps the entries of a list in memory and can be edited at runtime
+type MemoryList struct {
+	ips      map[string]struct{}
+	networks map[string]*net.IPNet
+	tokens   map[string]struct{}
+	headers  map[string]map[string]struct{}
+	mutex    sync.RWMutex
+}
+
+// NewMemoryList creates a list with the given entries, see ParseEntry
+func NewMemoryList(entries ...string) (*MemoryList, error) {
+	m := &MemoryList{}
+	m.reset()
+	if err := m.Add(entries...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MemoryList) reset() {
+	m.ips = make(map[string]struct{})
+	m.networks = make(map[string]*net.IPNet)
+	m.tokens = make(map[string]struct{})
+	m.headers = make(map[string]map[string]struct{})
+}
+
+func (m *MemoryList) Contains(ctx context.Context, r Request) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if r.Token != "" {
+		if _, exists := m.tokens[r.Token]; exists {
+			return true, nil
+		}
+	}
+
+	if ip := ParseIP(r.IP); ip != nil {
+		if _, exists := m.ips[ip.String()]; exists {
+			return true, nil
+		}
+		for _, network := range m.networks {
+			if network.Contains(ip) {
+				return true, nil
+			}
+		}
+	}
+
+	for name, values := range m.headers {
+		requestValues, present := r.Header[name]
+		if !present {
+			continue
+		}
+		if _, anyValue := values[""]; anyValue {
+			return true, nil
+		}
+		for _, value := range requestValues {
+			if _, exists := values[value]; exists {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Add adds entries to the list. No entry is added when one of them is invalid
+func (m *MemoryList) Add(entries ...string) error {
+	canonical, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, entry := range canonical {
+		m.add(entry)
+	}
+	return nil
+}
+
+// Remove removes entries from the list
+func (m *MemoryList) Remove(entries ...string) error {
+	canonical, err := parseEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, entry := range canonical {
+		m.remove(entry)
+	}
+	return nil
+}
+
+// Entries returns the entries of the list in their canonical form, sorted
+func (m *MemoryList) Entries() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var entries []string
+	for ip := range m.ips {
+		entries = append(entries, "ip:"+ip)
+	}
+	for network := range m.networks {
+		entries = append(entries, "ip:"+network)
+	}
+	for token := range m.tokens {
+		entries = append(entries, "token:"+token)
+	}
+	for name, values := range m.headers {
+		for value := range values {
+			if value == "" {
+				entries = append(entries, "header:"+name)
+			} else {
+				entries = append(entries, "header:"+name+"="+value)
+			}
+		}
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// replace swaps every entry at once
+func (m *MemoryList) replace(entries []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reset()
+	for _, entry := range entries {
+		m.add(entry)
+	}
+}
+
+// add adds a canonical entry, the mutex must be held
+func (m *MemoryList) add(entry string) {
+	kind, value, _ := strings.Cut(entry, ":")
+	switch kind {
+	case "ip":
+		network, _ := ParseNetwork(value)
+		if ones, bits := network.Mask.Size(); ones == bits {
+			m.ips[network.IP.String()] = struct{}{}
+		} else {
+			m.networks[network.String()] = network
+		}
+	case "token":
+		m.tokens[value] = struct{}{}
+	case "header":
+		name, headerValue, _ := strings.Cut(value, "=")
+		if m.headers[name] == nil {
+			m.headers[name] = make(map[string]struct{})
+		}
+		m.headers[name][headerValue] = struct{}{}
+	}
+}
+
+// remove removes a canonical entry, the mutex must be held
+func (m *MemoryList) remove(entry string) {
+	kind, value, _ := strings.Cut(entry, ":")
+	switch kind {
+	case "ip":
+		network, _ := ParseNetwork(value)
+		delete(m.ips, network.IP.String())
+		delete(m.networks, network.String())
+	case "token":
+		delete(m.tokens, value)
+	case "header":
+		name, headerValue, _ := strings.Cut(value, "=")
+		delete(m.headers[name], headerValue)
+		if len(m.headers[name]) == 0 {
+			delete(m.headers, name)
+		}
+	}
+}
+
+func parseEntries(entries []string) ([]string, error) {
+	canonical := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		parsed, err := ParseEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		canonical = append(canonical, parsed)
+	}
+	return canonical, nil
+}
+
+// ParseIP parses an IP address with an optional port, brackets or IPv6 zone,
+// as written in connection addresses and forwarding headers. IPv4 addresses are
+// returned in their 4 byte form
+func ParseIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if i := strings.LastIndexByte(address, '%'); i >= 0 {
+		address = address[:i]
+	}
+
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// ParseNetwork parses a CIDR, or a single IP in any form accepted by ParseIP, as
+// a network
+func ParseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := network.IP.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+			network.IP = ip4
+		}
+		return network, nil
+	}
+
+	ip := ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address")
+	}
+	bits := len(ip) * 8
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,158 @@
+package access
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/joho/godotenv"
+)
+
+func TestParseEntry(t *testing.T) {
+	tests := []struct {
+		entry    string
+		expected string
+	}{
+		{"ip:10.0.0.1", "ip:10.0.0.1"},
+		{"ip:10.1.2.3/8", "ip:10.0.0.0/8"},
+		{"ip:2001:db8::/32", "ip:2001:db8::/32"},
+		{"ip:[2001:db8::1]", "ip:2001:db8::1"},
+		{"token:abc123", "token:abc123"},
+		{"header:x-internal-service", "header:X-Internal-Service"},
+		{"header:x-internal-service=ci", "header:X-Internal-Service=ci"},
+	}
+	for _, tt := range tests {
+		entry, err := ParseEntry(tt.entry)
+		if err != nil || entry != tt.expected {
+			t.Errorf("ParseEntry(%q) = %q, %v, expected %q", tt.entry, entry, err, tt.expected)
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.1", "ip:", "ip:10.0.0.300", "token:", "header:=ci", "user:admin"} {
+		if _, err := ParseEntry(entry); err == nil {
+			t.Errorf("Expected an error for %q", entry)
+		}
+	}
+}
+
+func TestMemoryList(t *testing.T) {
+	ctx := context.Background()
+	list, err := NewMemoryList("ip:10.0.0.0/8", "ip:192.168.1.1", "ip:2001:db8::/32", "token:monitoring", "header:X-Internal-Service=ci")
+	if err != nil {
+		t.Fatalf("Failed to create list: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		request  Request
+		expected bool
+	}{
+		{"IP in network", Request{IP: "10.20.30.40"}, true},
+		{"IP with port", Request{IP: "192.168.1.1:54321"}, true},
+		{"IPv6 in network", Request{IP: "2001:db8::1"}, true},
+		{"IPv6 with brackets", Request{IP: "[2001:db8::1]"}, true},
+		{"IPv6 with zone", Request{IP: "2001:db8::1%eth0"}, true},
+		{"Other IP", Request{IP: "192.168.1.2"}, false},
+		{"Token", Request{IP: "192.168.1.2", Token: "monitoring"}, true},
+		{"Other token", Request{IP: "192.168.1.2", Token: "abc123"}, false},
+		{"Header value", Request{Header: http.Header{"X-Internal-Service": {"ci"}}}, true},
+		{"Other header value", Request{Header: http.Header{"X-Internal-Service": {"billing"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched, err := list.Contains(ctx, tt.request)
+			if err != nil {
+				t.Fatalf("Failed to check list: %v", err)
+			}
+			if matched != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, matched)
+			}
+		})
+	}
+
+	t.Run("Entries are edited at runtime", func(t *testing.T) {
+		if err := list.Add("header:X-Partner"); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+		if err := list.Remove("ip:10.0.0.0/8", "token:monitoring"); err != nil {
+			t.Fatalf("Failed to remove entries: %v", err)
+		}
+
+		if matched, _ := list.Contains(ctx, Request{IP: "10.20.30.40", Token: "monitoring"}); matched {
+			t.Error("Expected removed entries not to match")
+		}
+		if matched, _ := list.Contains(ctx, Request{Header: http.Header{"X-Partner": {"acme"}}}); !matched {
+			t.Error("Expected any value of a header entry without value to match")
+		}
+
+		expected := []string{"header:X-Internal-Service=ci", "header:X-Partner", "ip:192.168.1.1", "ip:2001:db8::/32"}
+		if entries := list.Entries(); !reflect.DeepEqual(entries, expected) {
+			t.Errorf("Expected entries %v, got %v", expected, entries)
+		}
+	})
+
+	t.Run("Invalid entries are not added", func(t *testing.T) {
+		if err := list.Add("token:abuser", "ip:not-an-ip"); err == nil {
+			t.Fatal("Expected an error for an invalid entry")
+		}
+		if matched, _ := list.Contains(ctx, Request{Token: "abuser"}); matched {
+			t.Error("Expected no entry to be added")
+		}
+	})
+}
+
+func TestRedisList(t *testing.T) {
+	_ = godotenv.Load("../../.env")
+
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	client := redis.NewClient(&redis.Options{Addr: host + ":6379", Password: os.Getenv("REDIS_PASSWORD")})
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	client.Del(ctx, "test:denylist")
+	defer client.Del(ctx, "test:denylist")
+
+	client.SAdd(ctx, "test:denylist", "ip:203.0.113.0/24", "not an entry")
+	list, err := NewRedisList(ctx, client, "test:denylist", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create list: %v", err)
+	}
+
+	if matched, _ := list.Contains(ctx, Request{IP: "203.0.113.7"}); !matched {
+		t.Error("Expected the entries of the set to be loaded")
+	}
+
+	if err := list.Add(ctx, "token:abuser"); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	if members := client.SMembers(ctx, "test:denylist").Val(); len(members) != 3 {
+		t.Errorf("Expected the entry to be added to the set, got %v", members)
+	}
+	if matched, _ := list.Contains(ctx, Request{Token: "abuser"}); !matched {
+		t.Error("Expected added entries to match at once")
+	}
+
+	// Entries changed by other instances are picked up after the refresh interval
+	client.SRem(ctx, "test:denylist", "ip:203.0.113.0/24")
+	deadline := time.Now().Add(time.Second)
+	for {
+		matched, _ := list.Contains(ctx, Request{IP: "203.0.113.7"})
+		if !matched {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the removed entry to stop matching after a refresh")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
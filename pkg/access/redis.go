@@ -0,0 +1,103 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisList keeps the entries of a list in a Redis set, so they can be managed
+// with SADD and SREM for every instance at once. Entries are cached in memory and
+// reloaded in the background once they are older than the refresh interval, so
+// requests never wait for Redis
+type RedisList struct {
+	*MemoryList
+	client  redis.Cmdable
+	key     string
+	refresh time.Duration
+
+	loadedAt  atomic.Int64
+	reloading atomic.Bool
+}
+
+// NewRedisList creates a list backed by the Redis set at key and loads it. A zero
+// refresh interval only reloads the set on Reload
+func NewRedisList(ctx context.Context, client redis.Cmdable, key string, refresh time.Duration) (*RedisList, error) {
+	memoryList, _ := NewMemoryList()
+	r := &RedisList{MemoryList: memoryList, client: client, key: key, refresh: refresh}
+	if err := r.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RedisList) Contains(ctx context.Context, req Request) (bool, error) {
+	if r.refresh > 0 && time.Since(time.Unix(0, r.loadedAt.Load())) > r.refresh && r.reloading.CompareAndSwap(false, true) {
+		go func() {
+			defer r.reloading.Store(false)
+			if err := r.Reload(context.Background()); err != nil {
+				log.Printf("failed to reload access list %s: %v", r.key, err)
+			}
+		}()
+	}
+	return r.MemoryList.Contains(ctx, req)
+}
+
+// Reload reads the set again, keeping the current entries if it fails. Invalid
+// entries are logged and skipped
+func (r *RedisList) Reload(ctx context.Context) error {
+	members, err := r.client.SMembers(ctx, r.key).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load access list: %v", err)
+	}
+
+	entries := make([]string, 0, len(members))
+	for _, member := range members {
+		entry, err := ParseEntry(member)
+		if err != nil {
+			log.Printf("skipping entry of access list %s: %v", r.key, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	r.replace(entries)
+	r.loadedAt.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Add adds entries to the set and to the cache of this instance
+func (r *RedisList) Add(ctx context.Context, entries ...string) error {
+	canonical, err := parseEntries(entries)
+	if err != nil || len(canonical) == 0 {
+		return err
+	}
+	if err := r.client.SAdd(ctx, r.key, toInterfaces(canonical)...).Err(); err != nil {
+		return fmt.Errorf("failed to add access list entries: %v", err)
+	}
+	return r.MemoryList.Add(canonical...)
+}
+
+// Remove removes entries from the set and from the cache of this instance
+func (r *RedisList) Remove(ctx context.Context, entries ...string) error {
+	canonical, err := parseEntries(entries)
+	if err != nil || len(canonical) == 0 {
+		return err
+	}
+	if err := r.client.SRem(ctx, r.key, toInterfaces(canonical)...).Err(); err != nil {
+		return fmt.Errorf("failed to remove access list entries: %v", err)
+	}
+	return r.MemoryList.Remove(canonical...)
+}
+
+func toInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
@@ -0,0 +1,447 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/access"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/middleware"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/tokens"
+	"github.com/go-redis/redis/v8"
+)
+
+// Addr returns the address the server listens on
+func (f *File) Addr() string {
+	if f.Server.Addr != "" {
+		return f.Server.Addr
+	}
+	return ":8080"
+}
+
+// NewStorage creates the storage of the file, connecting to Redis on
+// localhost:6379 by default
+func (f *File) NewStorage() (storage.Storage, error) {
+	if f.Storage.Type == "memory" {
+		return f.NewMemoryStorage(), nil
+	}
+
+	return storage.NewRedisStorageWithOptions(f.Storage.Redis.options()...)
+}
+
+// options converts the Redis settings of the file, the address first so the
+// other settings override the ones of the URL
+func (r Redis) options() []storage.RedisOption {
+	var options []storage.RedisOption
+	switch {
+	case r.URL != "":
+		options = append(options, storage.WithURL(r.URL))
+	case r.MasterName != "":
+		options = append(options, storage.WithSentinel(r.MasterName, r.Addrs...))
+	case len(r.Addrs) > 0:
+		options = append(options, storage.WithCluster(r.Addrs...))
+	default:
+		host, port := r.Host, r.Port
+		if host == "" {
+			host = "localhost"
+		}
+		if port == 0 {
+			port = 6379
+		}
+		options = append(options, storage.WithAddr(net.JoinHostPort(host, strconv.Itoa(port))))
+	}
+
+	// Each field overrides its own part of a URL
+	if r.Username != "" {
+		options = append(options, storage.WithUsername(r.Username))
+	}
+	if r.Password != "" {
+		options = append(options, storage.WithPassword(r.Password))
+	}
+	if r.SentinelUsername != "" || r.SentinelPassword != "" {
+		options = append(options, storage.WithSentinelCredentials(r.SentinelUsername, r.SentinelPassword))
+	}
+	if r.DB != 0 {
+		options = append(options, storage.WithDB(r.DB))
+	}
+
+	if r.TLS.Enabled {
+		options = append(options, storage.WithTLS(nil))
+	}
+	if r.TLS.CertFile != "" || r.TLS.KeyFile != "" {
+		options = append(options, storage.WithClientCertificate(r.TLS.CertFile, r.TLS.KeyFile))
+	}
+	if r.TLS.CAFile != "" {
+		options = append(options, storage.WithCACertificate(r.TLS.CAFile))
+	}
+
+	return append(options,
+		storage.WithTimeouts(time.Duration(r.DialTimeout), time.Duration(r.ReadTimeout), time.Duration(r.WriteTimeout)),
+		storage.WithPoolSize(r.PoolSize, r.MinIdleConns),
+		storage.WithPoolTimeouts(time.Duration(r.PoolTimeout), time.Duration(r.IdleTimeout)),
+	)
+}
+
+// NewMemoryStorage creates a memory storage with the settings of the file, used
+// as the storage or as the fallback storage of the local failure policy
+func (f *File) NewMemoryStorage() *storage.MemoryStorage {
+	var options []storage.MemoryOption
+	if f.Storage.Memory.MaxKeys > 0 {
+		options = append(options, storage.WithMaxKeys(f.Storage.Memory.MaxKeys))
+	}
+	if f.Storage.Memory.Shards > 0 {
+		options = append(options, storage.WithShards(f.Storage.Memory.Shards))
+	}
+	if f.Storage.Memory.CleanupInterval > 0 {
+		options = append(options, storage.WithCleanupInterval(time.Duration(f.Storage.Memory.CleanupInterval)))
+	}
+	return storage.NewMemoryStorage(options...)
+}
+
+// NewMiddleware validates the file and builds the limiter, its rules and the
+// middleware on a storage. The options are applied to every limiter, such as
+// limiter.WithFallbackStorage for the local failure policy
+func (f *File) NewMiddleware(s storage.Storage, opts ...limiter.Option) (*middleware.RateLimiterMiddleware, error) {
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	limiterOptions, err := f.limiterOptions(s)
+	if err != nil {
+		return nil, err
+	}
+	limiterOptions = append(limiterOptions, opts...)
+
+	rateLimiter, err := limiter.NewValidatedRateLimiter(s, f.config(f.Limits), limiterOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	ipResolver, err := middleware.NewIPResolver(f.ClientIP.TrustedProxies, f.ClientIP.Headers...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client IP configuration: %v", err)
+	}
+	options := []middleware.Option{middleware.WithClientIPResolver(ipResolver)}
+
+	if f.Key != "" {
+		extractor, err := keyExtractor(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, middleware.WithKeyExtractor(extractor))
+	}
+
+	headerStyle, err := f.headerStyle()
+	if err != nil {
+		return nil, err
+	}
+	options = append(options, middleware.WithHeaderStyle(headerStyle))
+
+	if len(f.Costs) > 0 {
+		options = append(options, middleware.WithCostFunc(middleware.RouteCosts(f.Costs)))
+	}
+
+	allowlist, err := f.Allowlist.list(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %v", err)
+	}
+	if allowlist != nil {
+		options = append(options, middleware.WithAllowlist(allowlist))
+	}
+	denylist, err := f.Denylist.list(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denylist: %v", err)
+	}
+	if denylist != nil {
+		options = append(options, middleware.WithDenylist(denylist))
+	}
+
+	if len(f.Rules) > 0 {
+		rules := make([]middleware.Rule, 0, len(f.Rules))
+		for _, rule := range f.Rules {
+			r, err := f.rule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", rule.Name, err)
+			}
+			rules = append(rules, r)
+		}
+
+		table, err := middleware.NewRules(s, rules, limiterOptions...)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, middleware.WithRules(table))
+	}
+
+	return middleware.NewRateLimiterMiddleware(rateLimiter, options...), nil
+}
+
+func (f *File) headerStyle() (middleware.HeaderStyle, error) {
+	switch f.Headers {
+	case "", "legacy":
+		return middleware.LegacyHeaders, nil
+	case "ietf":
+		return middleware.IETFHeaders, nil
+	case "none":
+		return middleware.NoHeaders, nil
+	}
+	return middleware.LegacyHeaders, fmt.Errorf("unsupported headers %q, use legacy, ietf or none", f.Headers)
+}
+
+// rule converts a rule of the file, inheriting the limits it does not set
+func (f *File) rule(rule Rule) (middleware.Rule, error) {
+	r := middleware.Rule{
+		Name:      rule.Name,
+		Methods:   rule.Methods,
+		Host:      rule.Host,
+		Path:      rule.Path,
+		PathMatch: middleware.PathMatch(rule.PathMatch),
+		Config:    f.config(rule.Limits.inherit(f.Limits)),
+		Skip:      rule.Skip,
+	}
+	if rule.Key != "" {
+		extractor, err := keyExtractor(rule.Key)
+		if err != nil {
+			return r, err
+		}
+		r.KeyExtractor = extractor
+	}
+	return r, nil
+}
+
+// list builds the access list of the file entries and the Redis set, nil when
+// both are empty
+func (a AccessList) list(s storage.Storage) (access.List, error) {
+	var lists access.Lists
+
+	if len(a.Entries) > 0 {
+		memoryList, err := access.NewMemoryList(a.Entries...)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, memoryList)
+	}
+
+	if a.RedisKey != "" {
+		redisStorage, ok := s.(interface{ Client() redis.UniversalClient })
+		if !ok {
+			return nil, fmt.Errorf("redis_key requires the Redis storage")
+		}
+		refresh := time.Duration(a.RefreshInterval)
+		if refresh == 0 {
+			refresh = 10 * time.Second
+		}
+		redisList, err := access.NewRedisList(context.Background(), redisStorage.Client(), a.RedisKey, refresh)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, redisList)
+	}
+
+	switch len(lists) {
+	case 0:
+		return nil, nil
+	case 1:
+		return lists[0], nil
+	}
+	return lists, nil
+}
+
+// tokenPolicies are token policies that also tell which tokens are valid
+type tokenPolicies interface {
+	tokens.PolicySource
+	tokens.Registry
+}
+
+// limiterOptions returns the token registry and policies of the file. Without a
+// registry, the tokens with a policy are the valid tokens, so random tokens
+// cannot bypass the IP limit
+func (f *File) limiterOptions(s storage.Storage) ([]limiter.Option, error) {
+	var options []limiter.Option
+
+	var registry tokens.Registry
+	if f.Tokens.File != "" {
+		fileRegistry, err := tokens.NewFileRegistry(f.Tokens.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token registry: %v", err)
+		}
+		registry = fileRegistry
+	} else if f.Tokens.RedisKey != "" {
+		redisStorage, ok := s.(interface{ Client() redis.UniversalClient })
+		if !ok {
+			return nil, fmt.Errorf("tokens.redis_key requires the Redis storage")
+		}
+		registry = tokens.NewRedisRegistry(redisStorage.Client(), f.Tokens.RedisKey)
+	}
+
+	var policies tokenPolicies
+	if f.Tokens.PolicyFile != "" {
+		filePolicies, err := tokens.LoadPolicyFile(f.Tokens.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load token policies: %v", err)
+		}
+		policies = filePolicies
+	} else if f.Tokens.PolicyRedisKey != "" {
+		redisStorage, ok := s.(interface{ Client() redis.UniversalClient })
+		if !ok {
+			return nil, fmt.Errorf("tokens.policy_redis_key requires the Redis storage")
+		}
+		policies = tokens.NewRedisPolicies(redisStorage.Client(), f.Tokens.PolicyRedisKey, f.tiers())
+	} else if len(f.Tokens.Tiers) > 0 || len(f.Tokens.Overrides) > 0 {
+		tiers := f.tiers()
+		for token, tier := range f.Tokens.Assignments {
+			if _, exists := tiers[tier]; !exists {
+				return nil, fmt.Errorf("token %q assigned to unknown tier %q", token, tier)
+			}
+		}
+
+		staticPolicies := tokens.NewStaticPolicies(tiers, f.Tokens.Assignments)
+		for token, override := range f.Tokens.Overrides {
+			staticPolicies.Override(token, override.policy())
+		}
+		policies = staticPolicies
+	}
+
+	if policies != nil {
+		options = append(options, limiter.WithTokenPolicies(policies))
+		if registry == nil {
+			registry = policies
+		}
+	}
+	if registry != nil {
+		options = append(options, limiter.WithTokenRegistry(registry))
+	}
+
+	return options, nil
+}
+
+// tiers converts the tiers of the file
+func (f *File) tiers() tokens.Tiers {
+	tiers := tokens.Tiers{}
+	for name, tier := range f.Tokens.Tiers {
+		tiers[name] = tier.policy()
+	}
+	return tiers
+}
+
+func (p Policy) policy() tokens.Policy {
+	return tokens.Policy{
+		Limit:         p.Limit,
+		Window:        time.Duration(p.Window),
+		BlockDuration: time.Duration(p.BlockDuration),
+	}
+}
+
+// config converts limits of the file, with the unknown token policy of the file
+func (f *File) config(l Limits) limiter.Config {
+	config := limiter.Config{
+		IPLimit:              l.IP,
+		TokenLimit:           l.Token,
+		BlockDuration:        time.Duration(l.BlockDuration),
+		Algorithm:            limiter.Algorithm(l.Algorithm),
+		Window:               time.Duration(l.Window),
+		Burst:                l.Burst,
+		RefillRate:           l.RefillRate,
+		IPv4Prefix:           l.IPv4Prefix,
+		IPv6Prefix:           l.IPv6Prefix,
+		UnknownTokenPolicy:   limiter.UnknownTokenPolicy(f.Tokens.UnknownPolicy),
+		FailurePolicy:        limiter.FailurePolicy(l.FailurePolicy),
+		StorageRetryInterval: time.Duration(l.StorageRetryInterval),
+	}
+
+	for _, prefixLimit := range l.PrefixLimits {
+		config.PrefixLimits = append(config.PrefixLimits, limiter.PrefixLimit{
+			IPv4Prefix: prefixLimit.IPv4Prefix,
+			IPv6Prefix: prefixLimit.IPv6Prefix,
+			Limit:      prefixLimit.Limit,
+		})
+	}
+	config.IPWindows = windowLimits(l.IPWindows)
+	config.TokenWindows = windowLimits(l.TokenWindows)
+	config.Penalty = limiter.Penalty{
+		Multiplier:       l.Penalty.Multiplier,
+		MaxBlockDuration: time.Duration(l.Penalty.MaxBlockDuration),
+		Decay:            time.Duration(l.Penalty.Decay),
+	}
+
+	return config
+}
+
+func windowLimits(windows []WindowLimit) []limiter.WindowLimit {
+	var limits []limiter.WindowLimit
+	for _, window := range windows {
+		limits = append(limits, limiter.WindowLimit{Limit: window.Limit, Window: time.Duration(window.Window)})
+	}
+	return limits
+}
+
+// inherit fills the fields not set in the limits of a rule from base
+func (l Limits) inherit(base Limits) Limits {
+	if l.IP == 0 {
+		l.IP = base.IP
+	}
+	if l.Token == 0 {
+		l.Token = base.Token
+	}
+	if l.BlockDuration == 0 {
+		l.BlockDuration = base.BlockDuration
+	}
+	if l.Algorithm == "" {
+		l.Algorithm = base.Algorithm
+	}
+	if l.Window == 0 {
+		l.Window = base.Window
+	}
+	if l.Burst == 0 {
+		l.Burst = base.Burst
+	}
+	if l.RefillRate == 0 {
+		l.RefillRate = base.RefillRate
+	}
+	if l.IPv4Prefix == 0 {
+		l.IPv4Prefix = base.IPv4Prefix
+	}
+	if l.IPv6Prefix == 0 {
+		l.IPv6Prefix = base.IPv6Prefix
+	}
+	if l.PrefixLimits == nil {
+		l.PrefixLimits = base.PrefixLimits
+	}
+	if l.IPWindows == nil {
+		l.IPWindows = base.IPWindows
+	}
+	if l.TokenWindows == nil {
+		l.TokenWindows = base.TokenWindows
+	}
+	if l.Penalty == (Penalty{}) {
+		l.Penalty = base.Penalty
+	}
+	if l.FailurePolicy == "" {
+		l.FailurePolicy = base.FailurePolicy
+	}
+	if l.StorageRetryInterval == 0 {
+		l.StorageRetryInterval = base.StorageRetryInterval
+	}
+	return l
+}
+
+// keyExtractor parses "header:<name>", "bearer", "query:<param>" or "cookie:<name>"
+func keyExtractor(spec string) (middleware.KeyExtractor, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch {
+	case kind == "bearer" && name == "":
+		return middleware.BearerToken(), nil
+	case kind == "header" && name != "":
+		return middleware.HeaderKey(name), nil
+	case kind == "query" && name != "":
+		return middleware.QueryKey(name), nil
+	case kind == "cookie" && name != "":
+		return middleware.CookieKey(name), nil
+	}
+	return nil, fmt.Errorf("unsupported key %q, use header:<name>, bearer, query:<param> or cookie:<name>", spec)
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApplyEnv overrides the fields of the file with the environment variables that
+// are set and not empty, read with getenv, usually os.Getenv. Every variable that
+// does not parse is reported:
+//
+//	RATE_LIMIT_IP, RATE_LIMIT_TOKEN  limits.ip, limits.token
+//	BLOCK_DURATION                   limits.block_duration, in seconds
+//	FAILURE_POLICY                   limits.failure_policy
+//	UNKNOWN_TOKEN_POLICY             tokens.unknown_policy
+//	TOKEN_FILE, TOKEN_REDIS_KEY      tokens.file, tokens.redis_key
+//	TOKEN_POLICY_FILE                tokens.policy_file
+//	TOKEN_POLICY_REDIS_KEY           tokens.policy_redis_key
+//	TRUSTED_PROXIES                  client_ip.trusted_proxies, comma separated
+//	CLIENT_IP_HEADERS                client_ip.headers, comma separated
+//	ALLOWLIST, DENYLIST              allowlist.entries, denylist.entries, comma separated
+//	STORAGE_TYPE                     storage.type
+//	REDIS_HOST, REDIS_PORT           storage.redis.host, storage.redis.port
+//	REDIS_PASSWORD, REDIS_DB         storage.redis.password, storage.redis.db
+//	REDIS_ADDRS                      storage.redis.addrs, comma separated
+//	REDIS_MASTER_NAME                storage.redis.master_name
+//	REDIS_URL, REDIS_USERNAME        storage.redis.url, storage.redis.username
+//	REDIS_TLS                        storage.redis.tls.enabled, true or false
+//	REDIS_TLS_CERT_FILE              storage.redis.tls.cert_file
+//	REDIS_TLS_KEY_FILE               storage.redis.tls.key_file
+//	REDIS_TLS_CA_FILE                storage.redis.tls.ca_file
+//	REDIS_DIAL_TIMEOUT               storage.redis.dial_timeout, such as 5s
+//	REDIS_READ_TIMEOUT               storage.redis.read_timeout, such as 3s
+//	REDIS_WRITE_TIMEOUT              storage.redis.write_timeout, such as 3s
+//	REDIS_POOL_TIMEOUT               storage.redis.pool_timeout, such as 4s
+//	REDIS_POOL_SIZE                  storage.redis.pool_size
+//	REDIS_MIN_IDLE_CONNS             storage.redis.min_idle_conns
+func (f *File) ApplyEnv(getenv func(string) string) error {
+	ints := map[string]*int{
+		"RATE_LIMIT_IP":        &f.Limits.IP,
+		"RATE_LIMIT_TOKEN":     &f.Limits.Token,
+		"REDIS_PORT":           &f.Storage.Redis.Port,
+		"REDIS_DB":             &f.Storage.Redis.DB,
+		"REDIS_POOL_SIZE":      &f.Storage.Redis.PoolSize,
+		"REDIS_MIN_IDLE_CONNS": &f.Storage.Redis.MinIdleConns,
+	}
+	var errs []error
+	for _, name := range sortedKeys(ints) {
+		if value := getenv(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: must be an integer", name, value))
+				continue
+			}
+			*ints[name] = parsed
+		}
+	}
+
+	if value := getenv("BLOCK_DURATION"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid BLOCK_DURATION %q: must be a number of seconds", value))
+		} else {
+			f.Limits.BlockDuration = Duration(time.Duration(seconds) * time.Second)
+		}
+	}
+
+	texts := map[string]*string{
+		"FAILURE_POLICY":         &f.Limits.FailurePolicy,
+		"UNKNOWN_TOKEN_POLICY":   &f.Tokens.UnknownPolicy,
+		"TOKEN_FILE":             &f.Tokens.File,
+		"TOKEN_REDIS_KEY":        &f.Tokens.RedisKey,
+		"TOKEN_POLICY_FILE":      &f.Tokens.PolicyFile,
+		"TOKEN_POLICY_REDIS_KEY": &f.Tokens.PolicyRedisKey,
+		"STORAGE_TYPE":           &f.Storage.Type,
+		"REDIS_HOST":             &f.Storage.Redis.Host,
+		"REDIS_PASSWORD":         &f.Storage.Redis.Password,
+		"REDIS_MASTER_NAME":      &f.Storage.Redis.MasterName,
+		"REDIS_URL":              &f.Storage.Redis.URL,
+		"REDIS_USERNAME":         &f.Storage.Redis.Username,
+		"REDIS_TLS_CERT_FILE":    &f.Storage.Redis.TLS.CertFile,
+		"REDIS_TLS_KEY_FILE":     &f.Storage.Redis.TLS.KeyFile,
+		"REDIS_TLS_CA_FILE":      &f.Storage.Redis.TLS.CAFile,
+	}
+	for name, field := range texts {
+		if value := getenv(name); value != "" {
+			*field = value
+		}
+	}
+
+	if value := getenv("TRUSTED_PROXIES"); value != "" {
+		f.ClientIP.TrustedProxies = splitList(value)
+	}
+	if value := getenv("CLIENT_IP_HEADERS"); value != "" {
+		f.ClientIP.Headers = splitList(value)
+	}
+	durations := map[string]*Duration{
+		"REDIS_DIAL_TIMEOUT":  &f.Storage.Redis.DialTimeout,
+		"REDIS_READ_TIMEOUT":  &f.Storage.Redis.ReadTimeout,
+		"REDIS_WRITE_TIMEOUT": &f.Storage.Redis.WriteTimeout,
+		"REDIS_POOL_TIMEOUT":  &f.Storage.Redis.PoolTimeout,
+	}
+	for _, name := range sortedKeys(durations) {
+		if value := getenv(name); value != "" {
+			if err := durations[name].UnmarshalText([]byte(value)); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s %q: must be a duration such as 5s", name, value))
+			}
+		}
+	}
+
+	if value := getenv("REDIS_TLS"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid REDIS_TLS %q: must be true or false", value))
+		} else {
+			f.Storage.Redis.TLS.Enabled = enabled
+		}
+	}
+
+	if value := getenv("REDIS_ADDRS"); value != "" {
+		f.Storage.Redis.Addrs = splitList(value)
+	}
+	if value := getenv("ALLOWLIST"); value != "" {
+		f.Allowlist.Entries = splitList(value)
+	}
+	if value := getenv("DENYLIST"); value != "" {
+		f.Denylist.Entries = splitList(value)
+	}
+
+	return errors.Join(errs...)
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
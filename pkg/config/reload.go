@@ -0,0 +1,146 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/middleware"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+	"github.com/go-redis/redis/v8"
+)
+
+// Reloader serves requests with the middleware built from a policy file and
+// swaps it atomically when the file changes. Invalid files are rejected and the
+// previous middleware is kept. The storage is shared by every version, so
+// counters and blocks survive reloads, but storage settings need a restart
+type Reloader struct {
+	path    string
+	storage storage.Storage
+	getenv  func(string) string
+	options []limiter.Option
+
+	current atomic.Pointer[middleware.RateLimiterMiddleware]
+	mutex   sync.Mutex
+}
+
+// NewReloader loads the policy file, applying the environment read with getenv,
+// and builds its middleware on the storage with the limiter options
+func NewReloader(path string, s storage.Storage, getenv func(string) string, opts ...limiter.Option) (*Reloader, error) {
+	r := &Reloader{path: path, storage: s, getenv: getenv, options: opts}
+
+	m, err := r.build()
+	if err != nil {
+		return nil, err
+	}
+	r.current.Store(m)
+	return r, nil
+}
+
+// Handler limits requests with the middleware of the current policy file
+func (r *Reloader) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().Handler(next).ServeHTTP(w, req)
+	})
+}
+
+// Reload reads the policy file again and swaps the middleware. On error the
+// previous middleware is kept and the error is logged and returned
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	m, err := r.build()
+	if err != nil {
+		log.Printf("failed to reload rate limit policies from %s, keeping the previous ones: %v", r.path, err)
+		return err
+	}
+
+	r.current.Store(m)
+	log.Printf("rate limit policies reloaded from %s", r.path)
+	return nil
+}
+
+func (r *Reloader) build() (*middleware.RateLimiterMiddleware, error) {
+	file, err := Load(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.ApplyEnv(r.getenv); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return file.NewMiddleware(r.storage, r.options...)
+}
+
+// WatchFile polls the policy file every interval and reloads it when its size or
+// modification time changes, until ctx is done
+func (r *Reloader) WatchFile(ctx context.Context, interval time.Duration) {
+	last, _ := os.Stat(r.path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.path)
+		if err != nil {
+			log.Printf("failed to watch rate limit policies: %v", err)
+			continue
+		}
+		if last != nil && info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+			continue
+		}
+
+		last = info
+		r.Reload()
+	}
+}
+
+// WatchSignals reloads the policy file whenever one of the signals is received,
+// usually syscall.SIGHUP, until ctx is done
+func (r *Reloader) WatchSignals(ctx context.Context, signals ...os.Signal) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	defer signal.Stop(received)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-received:
+			r.Reload()
+		}
+	}
+}
+
+// WatchRedis reloads the policy file whenever a message is published to a Redis
+// channel, so every instance can be reloaded at once, until ctx is done
+func (r *Reloader) WatchRedis(ctx context.Context, client redis.UniversalClient, channel string) {
+	pubsub := client.Subscribe(ctx, channel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-messages:
+			if !ok {
+				return
+			}
+			r.Reload()
+		}
+	}
+}
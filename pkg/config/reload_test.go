@@ -0,0 +1,96 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+func TestReloader(t *testing.T) {
+	path := writeFile(t, "config.yaml", "limits: {ip: 1, token: 10, block_duration: 1m}\n")
+	reloader, err := NewReloader(path, storage.NewMockStorage(), func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	handler := reloader.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if serve("192.168.1.1") != http.StatusOK || serve("192.168.1.1") != http.StatusTooManyRequests {
+		t.Fatal("Expected the initial limit of 1 request")
+	}
+
+	t.Run("Valid files are swapped in", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("limits: {ip: 3, token: 10, block_duration: 1m}\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if err := reloader.Reload(); err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if code := serve("192.168.1.2"); code != http.StatusOK {
+				t.Errorf("Request %d: expected the new limit to allow it, got %d", i+1, code)
+			}
+		}
+	})
+
+	t.Run("Invalid files keep the previous policies", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("limits: {ip: 1}\nheaders: fancy\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+		if err := reloader.Reload(); err == nil {
+			t.Fatal("Expected an error for an invalid file")
+		}
+
+		for i := 0; i < 3; i++ {
+			if code := serve("192.168.1.3"); code != http.StatusOK {
+				t.Errorf("Request %d: expected the previous limit of 3, got %d", i+1, code)
+			}
+		}
+	})
+
+	t.Run("Changed files are picked up by polling", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go reloader.WatchFile(ctx, 10*time.Millisecond)
+
+		time.Sleep(30 * time.Millisecond)
+		if err := os.WriteFile(path, []byte("limits: {ip: 10, token: 10, block_duration: 1m}\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+
+		// Blocks survive reloads, so every attempt uses a new IP
+		deadline := time.Now().Add(time.Second)
+		for attempt := 1; ; attempt++ {
+			ip := fmt.Sprintf("10.0.0.%d", attempt)
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if serve(ip) == http.StatusOK {
+					allowed++
+				}
+			}
+			if allowed == 10 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the new limit of 10 to be applied, %d requests allowed", allowed)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/access"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/middleware"
+	"github.com/go-redis/redis/v8"
+)
+
+// Validate reports every invalid or missing field of the file at once, one per
+// line, without connecting to the storage or reading the token files
+func (f *File) Validate() error {
+	var errs []error
+	check := func(section string, err error) {
+		if err != nil {
+			errs = append(errs, prefixed(section, err)...)
+		}
+	}
+
+	if f.Reload.Interval < 0 {
+		check("reload.interval", fmt.Errorf("must not be negative, got %v", f.Reload.Interval))
+	}
+
+	switch f.Storage.Type {
+	case "", "redis":
+	case "memory":
+		redisKeys := []struct {
+			section string
+			set     bool
+		}{
+			{"reload.redis_channel", f.Reload.RedisChannel != ""},
+			{"tokens.redis_key", f.Tokens.RedisKey != ""},
+			{"tokens.policy_redis_key", f.Tokens.PolicyRedisKey != ""},
+			{"allowlist.redis_key", f.Allowlist.RedisKey != ""},
+			{"denylist.redis_key", f.Denylist.RedisKey != ""},
+		}
+		for _, key := range redisKeys {
+			if key.set {
+				check(key.section, fmt.Errorf("requires the redis storage type"))
+			}
+		}
+	default:
+		check("storage.type", fmt.Errorf("unsupported storage type %q, use redis or memory", f.Storage.Type))
+	}
+
+	if port := f.Storage.Redis.Port; port < 0 || port > 65535 {
+		check("storage.redis.port", fmt.Errorf("must be between 1 and 65535, got %d", port))
+	}
+	if f.Storage.Redis.DB < 0 {
+		check("storage.redis.db", fmt.Errorf("must not be negative, got %d", f.Storage.Redis.DB))
+	}
+	check("storage.redis", f.Storage.Redis.validate())
+	if f.Storage.Redis.MasterName != "" && len(f.Storage.Redis.Addrs) == 0 {
+		check("storage.redis.addrs", fmt.Errorf("must list the Sentinels when master_name is set"))
+	}
+	if f.Storage.Redis.MasterName == "" && len(f.Storage.Redis.Addrs) > 0 && f.Storage.Redis.DB != 0 {
+		check("storage.redis.db", fmt.Errorf("must be 0 with a Cluster, got %d", f.Storage.Redis.DB))
+	}
+
+	if f.Storage.Memory.MaxKeys < 0 {
+		check("storage.memory.max_keys", fmt.Errorf("must not be negative, got %d", f.Storage.Memory.MaxKeys))
+	}
+	if f.Storage.Memory.Shards < 0 {
+		check("storage.memory.shards", fmt.Errorf("must not be negative, got %d", f.Storage.Memory.Shards))
+	}
+	if f.Storage.Memory.CleanupInterval < 0 {
+		check("storage.memory.cleanup_interval", fmt.Errorf("must not be negative, got %v", f.Storage.Memory.CleanupInterval))
+	}
+
+	check("limits", f.config(f.Limits).Validate())
+
+	for _, name := range sortedKeys(f.Tokens.Tiers) {
+		check(fmt.Sprintf("tokens.tiers.%s", name), f.Tokens.Tiers[name].validate())
+	}
+	if f.Tokens.PolicyRedisKey != "" && f.Tokens.PolicyFile == "" && len(f.Tokens.Tiers) == 0 {
+		check("tokens.policy_redis_key", fmt.Errorf("requires tiers"))
+	}
+	for _, token := range sortedKeys(f.Tokens.Assignments) {
+		tier := f.Tokens.Assignments[token]
+		if _, exists := f.Tokens.Tiers[tier]; !exists && f.Tokens.PolicyFile == "" {
+			check(fmt.Sprintf("tokens.tokens.%s", token), fmt.Errorf("assigned to unknown tier %q", tier))
+		}
+	}
+	for _, token := range sortedKeys(f.Tokens.Overrides) {
+		check(fmt.Sprintf("tokens.overrides.%s", token), f.Tokens.Overrides[token].validate())
+	}
+
+	_, err := middleware.NewIPResolver(f.ClientIP.TrustedProxies, f.ClientIP.Headers...)
+	check("client_ip", err)
+
+	if f.Key != "" {
+		_, err := keyExtractor(f.Key)
+		check("key", err)
+	}
+	_, err = f.headerStyle()
+	check("headers", err)
+
+	smallest := f.smallestLimit()
+	for _, route := range sortedKeys(f.Costs) {
+		if cost := f.Costs[route]; cost < 1 {
+			check(fmt.Sprintf("costs.%s", route), fmt.Errorf("must be at least 1, got %d", cost))
+		} else if smallest > 0 && cost > smallest {
+			check(fmt.Sprintf("costs.%s", route), fmt.Errorf("must not exceed the smallest limit %d, got %d", smallest, cost))
+		}
+	}
+
+	accessLists := []struct {
+		name string
+		list AccessList
+	}{{"allowlist", f.Allowlist}, {"denylist", f.Denylist}}
+	for _, a := range accessLists {
+		for i, entry := range a.list.Entries {
+			_, err := access.ParseEntry(entry)
+			check(fmt.Sprintf("%s.entries[%d]", a.name, i), err)
+		}
+		if a.list.RefreshInterval < 0 {
+			check(a.name+".refresh_interval", fmt.Errorf("must not be negative, got %v", a.list.RefreshInterval))
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range f.Rules {
+		section := fmt.Sprintf("rules[%d]", i)
+		if names[rule.Name] {
+			check(section, fmt.Errorf("duplicate rule name %q", rule.Name))
+		}
+		names[rule.Name] = true
+
+		r, err := f.rule(rule)
+		check(section, err)
+		check(section, r.Validate())
+	}
+
+	return errors.Join(errs...)
+}
+
+// smallestLimit returns the smallest of the top level limits and token policies,
+// the limits every cost is counted against, so costs that could never fit are
+// reported. Rules are left out, as they only see the costs of the routes they match
+func (f *File) smallestLimit() int {
+	smallest := 0
+	add := func(limit int) {
+		if limit > 0 && (smallest == 0 || limit < smallest) {
+			smallest = limit
+		}
+	}
+
+	add(f.Limits.IP)
+	add(f.Limits.Token)
+	add(f.Limits.Burst)
+	for _, prefixLimit := range f.Limits.PrefixLimits {
+		add(prefixLimit.Limit)
+	}
+	for _, window := range f.Limits.IPWindows {
+		add(window.Limit)
+	}
+	for _, window := range f.Limits.TokenWindows {
+		add(window.Limit)
+	}
+	for _, tier := range f.Tokens.Tiers {
+		add(tier.Limit)
+	}
+	for _, override := range f.Tokens.Overrides {
+		add(override.Limit)
+	}
+	return smallest
+}
+
+func (r Redis) validate() error {
+	var errs []error
+	if r.URL != "" {
+		if _, err := redis.ParseURL(r.URL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid url: %v", err))
+		}
+		if len(r.Addrs) > 0 || r.MasterName != "" {
+			errs = append(errs, fmt.Errorf("url cannot be combined with addrs or master_name"))
+		}
+	}
+	if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls.cert_file and tls.key_file must be set together"))
+	}
+
+	durations := map[string]Duration{
+		"dial_timeout":  r.DialTimeout,
+		"read_timeout":  r.ReadTimeout,
+		"write_timeout": r.WriteTimeout,
+		"pool_timeout":  r.PoolTimeout,
+		"idle_timeout":  r.IdleTimeout,
+	}
+	for _, name := range sortedKeys(durations) {
+		if durations[name] < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %v", name, durations[name]))
+		}
+	}
+	if r.PoolSize < 0 {
+		errs = append(errs, fmt.Errorf("pool_size must not be negative, got %d", r.PoolSize))
+	}
+	if r.MinIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("min_idle_conns must not be negative, got %d", r.MinIdleConns))
+	}
+	return errors.Join(errs...)
+}
+
+func (p Policy) validate() error {
+	var errs []error
+	if p.Limit <= 0 {
+		errs = append(errs, fmt.Errorf("limit must be positive, got %d", p.Limit))
+	}
+	if p.Window < 0 {
+		errs = append(errs, fmt.Errorf("window must not be negative, got %v", p.Window))
+	}
+	if p.BlockDuration < 0 {
+		errs = append(errs, fmt.Errorf("block_duration must not be negative, got %v", p.BlockDuration))
+	}
+	return errors.Join(errs...)
+}
+
+// prefixed flattens joined errors and prefixes each of them with the section
+// of the file they belong to
+func prefixed(section string, err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var errs []error
+		for _, err := range joined.Unwrap() {
+			errs = append(errs, prefixed(section, err)...)
+		}
+		return errs
+	}
+	return []error{fmt.Errorf("%s: %w", section, err)}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
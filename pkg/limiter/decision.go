@@ -0,0 +1,72 @@
+package limiter
+
+import (
+	"errors"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+var (
+	// ErrLimitExceeded is returned by CheckLimit when the request is over the limit
+	ErrLimitExceeded = errors.New("rate limit exceeded")
+
+	// ErrStorageUnavailable wraps every error returned by the storage
+	ErrStorageUnavailable = errors.New("rate limit storage unavailable")
+
+	// ErrUnsupportedAlgorithm is returned when the algorithm is unknown or the
+	// storage does not implement it
+	ErrUnsupportedAlgorithm = errors.New("unsupported rate limit algorithm")
+)
+
+// Rules a request can be limited by
+const (
+	RuleIP    = "IP"
+	RuleToken = "token"
+)
+
+// Decision describes the outcome of a rate limit check
+type Decision struct {
+	// Allowed reports whether the request may proceed
+	Allowed bool
+
+	// Limit is the allowance of the key, the number of requests per window or
+	// the burst size for TokenBucket and GCRA
+	Limit int
+
+	// Window is the period the limit applies to
+	Window time.Duration
+
+	// Remaining is the number of requests still available for the key
+	Remaining int
+
+	// ResetAt is when the key is back to its full allowance
+	ResetAt time.Time
+
+	// RetryAfter is how long a rejected client has to wait before retrying
+	RetryAfter time.Duration
+
+	// Key is the storage key the request was counted against
+	Key string
+
+	// Rule is the rule that matched the request, RuleIP or RuleToken
+	Rule string
+}
+
+func newDecision(key, rule string, limit int, window time.Duration, result storage.Result) Decision {
+	remaining := int(result.Remaining)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return Decision{
+		Allowed:    result.Allowed,
+		Limit:      limit,
+		Window:     window,
+		Remaining:  remaining,
+		ResetAt:    time.Now().Add(result.ResetAfter),
+		RetryAfter: result.RetryAfter,
+		Key:        key,
+		Rule:       rule,
+	}
+}
@@ -0,0 +1,100 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// FailurePolicy decides what happens to requests while the storage is unavailable
+type FailurePolicy string
+
+const (
+	// FailClosed rejects requests with an error wrapping ErrStorageUnavailable
+	FailClosed FailurePolicy = "closed"
+
+	// FailOpen lets requests through
+	FailOpen FailurePolicy = "open"
+
+	// FailLocal limits requests with the fallback storage until the storage
+	// recovers. Without a fallback storage it behaves like FailClosed
+	FailLocal FailurePolicy = "local"
+)
+
+// WithFallbackStorage sets the storage used by the FailLocal policy, usually an
+// in-memory storage local to the instance
+func WithFallbackStorage(fallback storage.Storage) Option {
+	return func(rl *RateLimiter) {
+		rl.fallback = &RateLimiter{storage: fallback, config: rl.config}
+	}
+}
+
+// WithStorageErrorHook sets a function called with every error returned by the
+// storage, whatever the failure policy is
+func WithStorageErrorHook(hook func(error)) Option {
+	return func(rl *RateLimiter) {
+		rl.onStorageError = hook
+	}
+}
+
+// evaluate checks a key against the storage and applies the failure policy when
+// the storage fails or has failed within the last StorageRetryInterval
+func (rl *RateLimiter) evaluate(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	key = rl.storageKey(key)
+
+	if until := rl.unavailable.Load(); until != 0 && time.Now().UnixNano() < until {
+		return rl.onStorageFailure(ctx, key, p, cost, fmt.Errorf("%w: waiting to retry", ErrStorageUnavailable))
+	}
+
+	decision, err := rl.check(ctx, key, p, cost)
+	if err == nil || !errors.Is(err, ErrStorageUnavailable) {
+		return decision, err
+	}
+
+	rl.unavailable.Store(time.Now().Add(rl.storageRetryInterval()).UnixNano())
+	log.Printf("rate limiter storage failed, applying the %s failure policy: %v", rl.failurePolicy(), err)
+	if rl.onStorageError != nil {
+		rl.onStorageError(err)
+	}
+
+	return rl.onStorageFailure(ctx, key, p, cost, err)
+}
+
+func (rl *RateLimiter) onStorageFailure(ctx context.Context, key string, p policy, cost int, err error) (Decision, error) {
+	switch rl.failurePolicy() {
+	case FailOpen:
+		return Decision{
+			Allowed:   true,
+			Limit:     p.limit,
+			Window:    p.window,
+			Remaining: p.limit,
+			ResetAt:   time.Now().Add(p.window),
+			Key:       key,
+			Rule:      p.rule,
+		}, nil
+	case FailLocal:
+		if rl.fallback != nil {
+			return rl.fallback.check(ctx, key, p, cost)
+		}
+	}
+
+	return Decision{}, err
+}
+
+func (rl *RateLimiter) failurePolicy() FailurePolicy {
+	if rl.config.FailurePolicy != "" {
+		return rl.config.FailurePolicy
+	}
+	return FailClosed
+}
+
+func (rl *RateLimiter) storageRetryInterval() time.Duration {
+	if rl.config.StorageRetryInterval > 0 {
+		return rl.config.StorageRetryInterval
+	}
+	return 5 * time.Second
+}
@@ -0,0 +1,37 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// checkGCRA applies the generic cell rate algorithm. Requests are expected one
+// emission interval (Window / limit) apart and a key may run ahead of that
+// schedule by up to Burst intervals before being rejected
+func (rl *RateLimiter) checkGCRA(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	gcraStorage, ok := rl.storage.(storage.GCRAStorage)
+	if !ok {
+		return Decision{}, fmt.Errorf("%w: storage does not support %s", ErrUnsupportedAlgorithm, GCRA)
+	}
+
+	if p.limit <= 0 {
+		return newDecision(key, p.rule, p.limit, p.window, storage.Result{}), nil
+	}
+
+	// Limits above one request per nanosecond of the window are rounded to one,
+	// as the storages divide by the interval
+	burst := rl.burst(p.limit)
+	interval := p.window / time.Duration(p.limit)
+	if interval < time.Nanosecond {
+		interval = time.Nanosecond
+	}
+	result, err := gcraStorage.GCRA(ctx, key, burst, interval, int64(cost))
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to check %s arrival time: %w: %v", p.rule, ErrStorageUnavailable, err)
+	}
+
+	return newDecision(key, p.rule, int(burst), p.window, result), nil
+}
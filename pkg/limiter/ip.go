@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// RuleIPPrefix is the rule of the limits set by PrefixLimits
+const RuleIPPrefix = "IP prefix"
+
+// PrefixLimit caps the requests of a whole network. A zero prefix length
+// disables the limit for that address family
+type PrefixLimit struct {
+	IPv4Prefix int
+	IPv6Prefix int
+	Limit      int
+}
+
+// allowIP checks the limit of the client network and of every PrefixLimit it
+// belongs to. The first rejection wins, otherwise the most restrictive decision
+// is returned
+func (rl *RateLimiter) allowIP(ctx context.Context, ip string, cost int) (Decision, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return rl.evaluate(ctx, ip, rl.policy(RuleIP, rl.config.IPLimit), cost)
+	}
+
+	decision, err := rl.evaluate(ctx, maskIP(parsed, rl.ipv4Prefix(), rl.ipv6Prefix()), rl.policy(RuleIP, rl.config.IPLimit), cost)
+	if err != nil || !decision.Allowed {
+		return decision, err
+	}
+
+	for _, prefixLimit := range rl.config.PrefixLimits {
+		prefix := prefixLimit.IPv6Prefix
+		if parsed.To4() != nil {
+			prefix = prefixLimit.IPv4Prefix
+		}
+		if prefix <= 0 {
+			continue
+		}
+
+		key := fmt.Sprintf("net:%s", maskIP(parsed, prefix, prefix))
+		prefixDecision, err := rl.evaluate(ctx, key, rl.policy(RuleIPPrefix, prefixLimit.Limit), cost)
+		if err != nil || !prefixDecision.Allowed {
+			return prefixDecision, err
+		}
+		if prefixDecision.Remaining < decision.Remaining {
+			decision = prefixDecision
+		}
+	}
+
+	return decision, nil
+}
+
+// maskIP returns the network of ip as a CIDR, or the plain address when the
+// prefix covers the whole address
+func maskIP(ip net.IP, ipv4Prefix, ipv6Prefix int) string {
+	prefix, bits := ipv6Prefix, 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, prefix, bits = ip4, ipv4Prefix, 32
+	}
+
+	if prefix <= 0 || prefix >= bits {
+		return ip.String()
+	}
+
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return network.String()
+}
+
+func (rl *RateLimiter) ipv4Prefix() int {
+	if rl.config.IPv4Prefix > 0 {
+		return rl.config.IPv4Prefix
+	}
+	return 32
+}
+
+func (rl *RateLimiter) ipv6Prefix() int {
+	if rl.config.IPv6Prefix > 0 {
+		return rl.config.IPv6Prefix
+	}
+	return 64
+}
@@ -3,82 +3,383 @@ package limiter
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/tokens"
+)
+
+// Algorithm selects how requests are counted against a limit
+type Algorithm string
+
+const (
+	// FixedWindow counts requests in fixed windows and blocks the key for
+	// BlockDuration when it sends a request after reaching the limit
+	FixedWindow Algorithm = "fixed_window"
+
+	// TokenBucket allows bursts up to Burst requests and refills the bucket at
+	// RefillRate tokens per second. Keys are never blocked, requests are simply
+	// rejected while the bucket is empty
+	TokenBucket Algorithm = "token_bucket"
+
+	// SlidingWindowLog keeps the time of every allowed request and counts the
+	// ones within the last Window. It is exact but stores one entry per request
+	SlidingWindowLog Algorithm = "sliding_window_log"
+
+	// SlidingWindowCounter approximates a sliding window by weighting the count
+	// of the previous fixed window, storing only two counters per key
+	SlidingWindowCounter Algorithm = "sliding_window_counter"
+
+	// GCRA spaces requests evenly over the Window, tolerating bursts of up to
+	// Burst requests. It stores a single timestamp per key
+	GCRA Algorithm = "gcra"
 )
 
 type Config struct {
 	IPLimit       int
 	TokenLimit    int
 	BlockDuration time.Duration
+
+	// Algorithm defaults to FixedWindow
+	Algorithm Algorithm
+
+	// Window is the period the limits apply to, defaults to one second
+	Window time.Duration
+
+	// Burst is the token bucket capacity and the GCRA burst tolerance,
+	// defaults to the limit of the key
+	Burst int
+
+	// RefillRate is the number of tokens added to the bucket per second,
+	// defaults to the limit of the key per Window
+	RefillRate float64
+
+	// IPv4Prefix and IPv6Prefix are the prefix lengths IPs are masked to before
+	// being limited, so a whole network shares the IP limit. They default to /32
+	// for IPv4 and /64 for IPv6, the smallest network usually assigned to a client
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// PrefixLimits are extra limits applied to coarser networks
+	PrefixLimits []PrefixLimit
+
+	// IPWindows and TokenWindows are extra limits over other periods, such as
+	// per minute and per day, enforced together with IPLimit and TokenLimit.
+	// Exceeding them rejects requests until they reset, without blocking the
+	// key as exceeding IPLimit and TokenLimit does. They are only supported by
+	// FixedWindow
+	IPWindows    []WindowLimit
+	TokenWindows []WindowLimit
+
+	// Penalty escalates the block duration of keys that keep tripping the limit.
+	// It applies to FixedWindow, the only algorithm blocking keys, with or without
+	// extra windows
+	Penalty Penalty
+
+	// UnknownTokenPolicy decides what happens to tokens missing from the token
+	// registry, defaults to LimitUnknownTokensByIP
+	UnknownTokenPolicy UnknownTokenPolicy
+
+	// FailurePolicy decides what happens to requests while the storage is
+	// unavailable, defaults to FailClosed
+	FailurePolicy FailurePolicy
+
+	// StorageRetryInterval is how long the storage is skipped after a failure
+	// before being tried again, defaults to five seconds
+	StorageRetryInterval time.Duration
+
+	// Namespace prefixes every storage key, so limiters sharing a storage count
+	// requests separately
+	Namespace string
+}
+
+// policy is the limit applied to a key by a rule
+type policy struct {
+	rule          string
+	limit         int
+	window        time.Duration
+	blockDuration time.Duration
+	windows       []WindowLimit
 }
 
 type RateLimiter struct {
 	storage storage.Storage
 	config  Config
+
+	registry       tokens.Registry
+	policies       tokens.PolicySource
+	fallback       *RateLimiter
+	onStorageError func(error)
+	unavailable    atomic.Int64
 }
 
-func NewRateLimiter(storage storage.Storage, config Config) *RateLimiter {
-	return &RateLimiter{
+// Option configures a RateLimiter
+type Option func(*RateLimiter)
+
+func NewRateLimiter(storage storage.Storage, config Config, opts ...Option) *RateLimiter {
+	rl := &RateLimiter{
 		storage: storage,
 		config:  config,
 	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	return rl
 }
 
+// CheckLimit reports whether a request from ip, identified by token when it is not
+// empty, is allowed. It returns an error wrapping ErrLimitExceeded when the request
+// is over the limit, use Allow to get the full Decision
 func (rl *RateLimiter) CheckLimit(ctx context.Context, ip, token string) error {
-	if token != "" {
-		// Check if token is blocked
-		if blocked, err := rl.storage.IsBlocked(ctx, token); err != nil {
-			return fmt.Errorf("failed to check token block status: %v", err)
-		} else if blocked {
-			return fmt.Errorf("token rate limit exceeded")
-		}
+	decision, err := rl.Allow(ctx, ip, token)
+	if err != nil {
+		return err
+	}
 
-		// Apply token-based rate limiting
-		count, err := rl.storage.Increment(ctx, token, time.Second)
-		if err != nil {
-			return fmt.Errorf("failed to increment token counter: %v", err)
-		}
+	if !decision.Allowed {
+		return fmt.Errorf("%s %w", decision.Rule, ErrLimitExceeded)
+	}
+
+	return nil
+}
+
+// Allow checks a request from ip, identified by token when it is not empty and
+// known to the token registry, and returns the Decision. Errors are only returned
+// when the check could not be performed, a request over the limit is reported by
+// Decision.Allowed
+func (rl *RateLimiter) Allow(ctx context.Context, ip, token string) (Decision, error) {
+	return rl.AllowN(ctx, ip, token, 1)
+}
+
+// AllowN checks a request that counts as cost requests, such as a batch or an
+// expensive query. The request is rejected when its whole cost does not fit in
+// the limit, even if the key has some allowance left
+func (rl *RateLimiter) AllowN(ctx context.Context, ip, token string, cost int) (Decision, error) {
+	return rl.allow(ctx, ip, token, true, cost)
+}
+
+// AllowKeyN is AllowN for a request identified by a key that is not an API token,
+// such as a session, a user ID or a route. The key gets the token limit and
+// policies, but it is not checked against the token registry, which only knows
+// tokens
+func (rl *RateLimiter) AllowKeyN(ctx context.Context, ip, key string, cost int) (Decision, error) {
+	return rl.allow(ctx, ip, key, false, cost)
+}
+
+func (rl *RateLimiter) allow(ctx context.Context, ip, token string, registered bool, cost int) (Decision, error) {
+	if cost < 1 {
+		return Decision{}, fmt.Errorf("request cost must be at least 1, got %d", cost)
+	}
 
-		if count > int64(rl.config.TokenLimit) {
-			if err := rl.storage.Block(ctx, token, rl.config.BlockDuration); err != nil {
-				return fmt.Errorf("failed to block token: %v", err)
+	if token != "" {
+		known, checked := true, true
+		if registered {
+			var err error
+			if known, checked, err = rl.knownToken(ctx, token); err != nil {
+				return Decision{}, err
 			}
+		}
 
-			if err := rl.storage.Reset(ctx, token); err != nil {
-				return fmt.Errorf("failed to reset token counter: %v", err)
+		if known {
+			p, err := rl.tokenPolicy(ctx, token)
+			if err != nil {
+				return Decision{}, err
 			}
-			return fmt.Errorf("token rate limit exceeded")
+
+			// Don't validate IP limit
+			return rl.evaluate(ctx, token, p, cost)
 		}
 
-		// Don't validate IP limit
-		return nil
+		if checked && rl.config.UnknownTokenPolicy == RejectUnknownTokens {
+			return Decision{Key: token, Rule: RuleToken}, ErrUnknownToken
+		}
 	}
 
-	// Check if IP is blocked
-	if blocked, err := rl.storage.IsBlocked(ctx, ip); err != nil {
-		return fmt.Errorf("failed to check IP block status: %v", err)
-	} else if blocked {
-		return fmt.Errorf("IP rate limit exceeded")
+	return rl.allowIP(ctx, ip, cost)
+}
+
+func (rl *RateLimiter) check(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	switch rl.config.Algorithm {
+	case "", FixedWindow:
+		return rl.checkFixedWindow(ctx, key, p, cost)
+	case TokenBucket:
+		return rl.checkTokenBucket(ctx, key, p, cost)
+	case SlidingWindowLog, SlidingWindowCounter:
+		return rl.checkSlidingWindow(ctx, key, p, cost)
+	case GCRA:
+		return rl.checkGCRA(ctx, key, p, cost)
+	default:
+		return Decision{}, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, rl.config.Algorithm)
+	}
+}
+
+func (rl *RateLimiter) checkFixedWindow(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	if len(p.windows) > 0 {
+		return rl.checkWindows(ctx, key, p, cost)
 	}
 
-	// Apply IP-based rate limiting
-	count, err := rl.storage.Increment(ctx, ip, time.Second)
+	// Check, count and block in a single atomic call when the storage supports it
+	if fixedStorage, ok := rl.storage.(storage.FixedWindowStorage); ok {
+		result, err := fixedStorage.FixedWindow(ctx, key, int64(p.limit), p.window, int64(cost), rl.blockPolicy(p))
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to count %s requests: %w: %v", p.rule, ErrStorageUnavailable, err)
+		}
+		return newDecision(key, p.rule, p.limit, p.window, result), nil
+	}
+
+	// Check if key is blocked
+	if blockedFor, err := rl.blockedFor(ctx, key, p.blockDuration); err != nil {
+		return Decision{}, fmt.Errorf("failed to check %s block status: %w: %v", p.rule, ErrStorageUnavailable, err)
+	} else if blockedFor != 0 {
+		return newDecision(key, p.rule, p.limit, p.window, storage.Result{
+			RetryAfter: blockedFor,
+			ResetAfter: blockedFor,
+		}), nil
+	}
+
+	count, err := rl.storage.IncrementBy(ctx, key, int64(cost), p.window)
 	if err != nil {
-		return fmt.Errorf("failed to increment IP counter: %v", err)
+		return Decision{}, fmt.Errorf("failed to increment %s counter: %w: %v", p.rule, ErrStorageUnavailable, err)
 	}
 
-	if count > int64(rl.config.IPLimit) {
-		if err := rl.storage.Block(ctx, ip, rl.config.BlockDuration); err != nil {
-			return fmt.Errorf("failed to block IP: %v", err)
+	// A request whose cost does not fit is taken back and rejected until the window
+	// resets, the key is only blocked once it had already reached the limit
+	if count > int64(p.limit) && count-int64(cost) < int64(p.limit) {
+		if _, err := rl.storage.IncrementBy(ctx, key, -int64(cost), p.window); err != nil {
+			return Decision{}, fmt.Errorf("failed to decrement %s counter: %w: %v", p.rule, ErrStorageUnavailable, err)
+		}
+
+		return newDecision(key, p.rule, p.limit, p.window, storage.Result{
+			Remaining:  int64(p.limit) - count + int64(cost),
+			RetryAfter: p.window,
+			ResetAfter: p.window,
+		}), nil
+	}
+
+	if count > int64(p.limit) {
+		// Reset before blocking, as resetting a key also lifts its block
+		if err := rl.storage.Reset(ctx, key); err != nil {
+			return Decision{}, fmt.Errorf("failed to reset %s counter: %w: %v", p.rule, ErrStorageUnavailable, err)
+		}
+
+		blockDuration, err := rl.penalize(ctx, key, p)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		if err := rl.storage.Block(ctx, key, blockDuration); err != nil {
+			return Decision{}, fmt.Errorf("failed to block %s: %w: %v", p.rule, ErrStorageUnavailable, err)
 		}
 
-		if err := rl.storage.Reset(ctx, ip); err != nil {
-			return fmt.Errorf("failed to reset IP counter: %v", err)
+		return newDecision(key, p.rule, p.limit, p.window, storage.Result{
+			RetryAfter: blockDuration,
+			ResetAfter: blockDuration,
+		}), nil
+	}
+
+	return newDecision(key, p.rule, p.limit, p.window, storage.Result{
+		Allowed:    true,
+		Remaining:  int64(p.limit) - count,
+		ResetAfter: p.window,
+	}), nil
+}
+
+// blockedFor returns the remaining block time of a key, or zero when it is not
+// blocked. Storages that cannot tell the remaining time report BlockDuration
+func (rl *RateLimiter) blockedFor(ctx context.Context, key string, blockDuration time.Duration) (time.Duration, error) {
+	if ttlStorage, ok := rl.storage.(storage.BlockTTLStorage); ok {
+		ttl, err := ttlStorage.BlockTTL(ctx, key)
+		if err != nil || ttl >= 0 {
+			return ttl, err
 		}
-		return fmt.Errorf("IP rate limit exceeded")
+		return blockDuration, nil
 	}
 
-	return nil
+	blocked, err := rl.storage.IsBlocked(ctx, key)
+	if err != nil || !blocked {
+		return 0, err
+	}
+	return blockDuration, nil
+}
+
+func (rl *RateLimiter) checkTokenBucket(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	bucketStorage, ok := rl.storage.(storage.TokenBucketStorage)
+	if !ok {
+		return Decision{}, fmt.Errorf("%w: storage does not support %s", ErrUnsupportedAlgorithm, TokenBucket)
+	}
+
+	capacity := rl.burst(p.limit)
+	rate := float64(p.limit) / p.window.Seconds()
+	if rl.config.RefillRate > 0 {
+		rate = rl.config.RefillRate
+	}
+
+	result, err := bucketStorage.TakeToken(ctx, key, capacity, rate, int64(cost))
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to take %s token: %w: %v", p.rule, ErrStorageUnavailable, err)
+	}
+
+	return newDecision(key, p.rule, int(capacity), p.window, result), nil
+}
+
+func (rl *RateLimiter) checkSlidingWindow(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	windowStorage, ok := rl.storage.(storage.SlidingWindowStorage)
+	if !ok {
+		return Decision{}, fmt.Errorf("%w: storage does not support %s", ErrUnsupportedAlgorithm, rl.config.Algorithm)
+	}
+
+	var result storage.Result
+	var err error
+	if rl.config.Algorithm == SlidingWindowLog {
+		result, err = windowStorage.SlidingWindowLog(ctx, key, int64(p.limit), p.window, int64(cost))
+	} else {
+		result, err = windowStorage.SlidingWindowCounter(ctx, key, int64(p.limit), p.window, int64(cost))
+	}
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to count %s requests: %w: %v", p.rule, ErrStorageUnavailable, err)
+	}
+
+	return newDecision(key, p.rule, p.limit, p.window, result), nil
+}
+
+// policy returns the configured window, block duration and extra windows for a
+// rule and limit
+func (rl *RateLimiter) policy(rule string, limit int) policy {
+	p := policy{
+		rule:          rule,
+		limit:         limit,
+		window:        rl.window(),
+		blockDuration: rl.config.BlockDuration,
+	}
+
+	switch rule {
+	case RuleIP:
+		p.windows = rl.config.IPWindows
+	case RuleToken:
+		p.windows = rl.config.TokenWindows
+	}
+	return p
+}
+
+// storageKey returns the key counted in the storage for a client key
+func (rl *RateLimiter) storageKey(key string) string {
+	if rl.config.Namespace == "" {
+		return key
+	}
+	return rl.config.Namespace + ":" + key
+}
+
+func (rl *RateLimiter) burst(limit int) int64 {
+	if rl.config.Burst > 0 {
+		return int64(rl.config.Burst)
+	}
+	return int64(limit)
+}
+
+func (rl *RateLimiter) window() time.Duration {
+	if rl.config.Window > 0 {
+		return rl.config.Window
+	}
+	return time.Second
 }
@@ -2,12 +2,32 @@ package limiter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/tokens"
 )
 
+// failingStorage simulates an unreachable storage
+type failingStorage struct {
+	storage.Storage
+}
+
+func (f failingStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+// failingRegistry simulates an unreachable token registry
+type failingRegistry struct{}
+
+func (failingRegistry) Exists(ctx context.Context, token string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
 func TestRateLimiter(t *testing.T) {
 	mockStorage := storage.NewMockStorage()
 	config := Config{
@@ -139,4 +159,634 @@ func TestRateLimiter(t *testing.T) {
 			t.Error("Expected token to be rate limited after exceeding token limit, but request was allowed")
 		}
 	})
+	t.Run("Token bucket allows bursts and refills over time", func(t *testing.T) {
+		ip := "192.168.1.4"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{
+			IPLimit:    5,
+			Algorithm:  TokenBucket,
+			Burst:      3,
+			RefillRate: 1,
+		})
+
+		// Should allow a burst of 3 requests
+		for i := 0; i < 3; i++ {
+			if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+				t.Errorf("Expected request %d to be allowed, got error: %v", i+1, err)
+			}
+		}
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request to be rejected with an empty bucket, but it was allowed")
+		}
+
+		// One token is refilled per second
+		mockStorage.AdvanceTime(time.Second)
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+			t.Errorf("Expected request after refill to be allowed, got error: %v", err)
+		}
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request to be rejected after using the refilled token, but it was allowed")
+		}
+
+		// The bucket never holds more than its capacity
+		mockStorage.AdvanceTime(time.Minute)
+
+		for i := 0; i < 3; i++ {
+			if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+				t.Errorf("Expected request %d to be allowed, got error: %v", i+1, err)
+			}
+		}
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected bucket to be capped at its capacity, but request was allowed")
+		}
+	})
+	t.Run("Sliding window log counts requests in the last window", func(t *testing.T) {
+		ip := "192.168.1.5"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{
+			IPLimit:   3,
+			Algorithm: SlidingWindowLog,
+			Window:    time.Minute,
+		})
+
+		for i := 0; i < 3; i++ {
+			if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+				t.Errorf("Expected request %d to be allowed, got error: %v", i+1, err)
+			}
+			mockStorage.AdvanceTime(10 * time.Second)
+		}
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request to be rejected within the window, but it was allowed")
+		}
+
+		// Only the first request leaves the window
+		mockStorage.AdvanceTime(30 * time.Second)
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+			t.Errorf("Expected request to be allowed once the oldest one left the window, got error: %v", err)
+		}
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request to be rejected, but it was allowed")
+		}
+	})
+
+	t.Run("Sliding window counter weights the previous window", func(t *testing.T) {
+		ip := "192.168.1.6"
+
+		mockStorage = storage.NewMockStorage()
+		mockStorage.SetCurrentTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		limiter = NewRateLimiter(mockStorage, Config{
+			IPLimit:   4,
+			Algorithm: SlidingWindowCounter,
+			Window:    time.Minute,
+		})
+
+		for i := 0; i < 4; i++ {
+			if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+				t.Errorf("Expected request %d to be allowed, got error: %v", i+1, err)
+			}
+		}
+
+		// A quarter into the next window the previous one still weighs 3 requests
+		mockStorage.AdvanceTime(time.Minute + 15*time.Second)
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+			t.Errorf("Expected request to be allowed, got error: %v", err)
+		}
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request to be rejected while the previous window still counts, but it was allowed")
+		}
+
+		// Halfway through, the previous window weighs 2 requests
+		mockStorage.AdvanceTime(15 * time.Second)
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+			t.Errorf("Expected request to be allowed, got error: %v", err)
+		}
+	})
+	t.Run("GCRA spaces requests over the window", func(t *testing.T) {
+		ip := "192.168.1.7"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{
+			IPLimit:   10,
+			Algorithm: GCRA,
+			Window:    10 * time.Second,
+			Burst:     2,
+		})
+
+		// Burst of 2 requests is tolerated
+		for i := 0; i < 2; i++ {
+			if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+				t.Errorf("Expected request %d to be allowed, got error: %v", i+1, err)
+			}
+		}
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request beyond the burst to be rejected, but it was allowed")
+		}
+
+		// One request is allowed per emission interval of 1 second
+		mockStorage.AdvanceTime(time.Second)
+
+		if err := limiter.CheckLimit(ctx, ip, ""); err != nil {
+			t.Errorf("Expected request after one interval to be allowed, got error: %v", err)
+		}
+		if err := limiter.CheckLimit(ctx, ip, ""); err == nil {
+			t.Error("Expected request to be rejected, but it was allowed")
+		}
+
+		// Limits above one request per nanosecond do not divide by zero
+		for _, s := range []storage.Storage{storage.NewMockStorage(), storage.NewMemoryStorage(storage.WithCleanupInterval(0))} {
+			limiter = NewRateLimiter(s, Config{IPLimit: 2e9, Algorithm: GCRA, Window: time.Second})
+			if decision, err := limiter.Allow(ctx, ip, ""); err != nil || !decision.Allowed {
+				t.Errorf("Expected request under a huge limit to be allowed with %T, got %+v, %v", s, decision, err)
+			}
+		}
+	})
+	t.Run("Every window of a key is enforced", func(t *testing.T) {
+		ip := "192.168.1.12"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{
+			IPLimit:       2,
+			BlockDuration: time.Minute,
+			IPWindows:     []WindowLimit{{Limit: 3, Window: time.Minute}},
+		})
+
+		for i := 0; i < 2; i++ {
+			if decision, _ := limiter.Allow(ctx, ip, ""); !decision.Allowed {
+				t.Errorf("Expected request %d to be allowed", i+1)
+			}
+		}
+
+		mockStorage.AdvanceTime(time.Second)
+		decision, _ := limiter.Allow(ctx, ip, "")
+		if !decision.Allowed || decision.Window != time.Minute || decision.Remaining != 0 {
+			t.Errorf("Expected the last request of the minute to be allowed, got %+v", decision)
+		}
+
+		// The extra windows reject requests until they reset, without blocking
+		mockStorage.AdvanceTime(time.Second)
+		decision, _ = limiter.Allow(ctx, ip, "")
+		if decision.Allowed || decision.Window != time.Minute || decision.RetryAfter != 58*time.Second {
+			t.Errorf("Expected the per minute window to trip until its reset, got %+v", decision)
+		}
+
+		mockStorage.AdvanceTime(58 * time.Second)
+		for i := 0; i < 2; i++ {
+			if decision, _ := limiter.Allow(ctx, ip, ""); !decision.Allowed {
+				t.Errorf("Expected request %d to be allowed in the next minute, got %+v", i+1, decision)
+			}
+		}
+
+		// Going over the per second window blocks the key
+		decision, _ = limiter.Allow(ctx, ip, "")
+		if decision.Allowed || decision.Window != time.Second || decision.Limit != 2 || decision.RetryAfter != time.Minute {
+			t.Errorf("Expected the key to be blocked for a minute, got %+v", decision)
+		}
+
+		mockStorage.AdvanceTime(time.Second)
+		if decision, _ := limiter.Allow(ctx, ip, ""); decision.Allowed || decision.RetryAfter != 59*time.Second {
+			t.Errorf("Expected the key to remain blocked, got %+v", decision)
+		}
+	})
+
+	t.Run("Requests are rejected when their cost does not fit", func(t *testing.T) {
+		ip := "192.168.1.13"
+
+		for _, algorithm := range []Algorithm{FixedWindow, TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA} {
+			mockStorage = storage.NewMockStorage()
+			limiter = NewRateLimiter(mockStorage, Config{
+				IPLimit:       10,
+				BlockDuration: time.Minute,
+				Algorithm:     algorithm,
+			})
+
+			if decision, _ := limiter.AllowN(ctx, ip, "", 8); !decision.Allowed || decision.Remaining != 2 {
+				t.Errorf("%s: expected request costing 8 to be allowed with 2 remaining, got %+v", algorithm, decision)
+			}
+			if decision, _ := limiter.AllowN(ctx, ip, "", 3); decision.Allowed {
+				t.Errorf("%s: expected request costing 3 to be rejected, got %+v", algorithm, decision)
+			}
+			if decision, _ := limiter.AllowN(ctx, ip, "", 2); !decision.Allowed {
+				t.Errorf("%s: expected the rejected request not to be counted, got %+v", algorithm, decision)
+			}
+		}
+
+		// Without the atomic fixed window, the rejected cost is taken back
+		mockStorage = storage.NewMockStorage()
+		separate := separateCallsStorage{mockStorage, mockStorage, mockStorage}
+		limiter = NewRateLimiter(separate, Config{IPLimit: 10, BlockDuration: time.Minute})
+		limiter.AllowN(ctx, ip, "", 8)
+		if decision, _ := limiter.AllowN(ctx, ip, "", 3); decision.Allowed || decision.Remaining != 2 || decision.RetryAfter != time.Second {
+			t.Errorf("Expected request costing 3 to be rejected until the window resets, got %+v", decision)
+		}
+		if decision, _ := limiter.AllowN(ctx, ip, "", 2); !decision.Allowed {
+			t.Errorf("Expected the rejected request not to be counted, got %+v", decision)
+		}
+		if decision, _ := limiter.AllowN(ctx, ip, "", 1); decision.Allowed || decision.RetryAfter != time.Minute {
+			t.Errorf("Expected the key at its limit to be blocked, got %+v", decision)
+		}
+
+		if _, err := limiter.AllowN(ctx, ip, "", 0); err == nil {
+			t.Error("Expected an error for a request without cost")
+		}
+	})
+
+	t.Run("Namespaces count requests separately", func(t *testing.T) {
+		ip := "192.168.1.14"
+
+		mockStorage = storage.NewMockStorage()
+		login := NewRateLimiter(mockStorage, Config{IPLimit: 1, BlockDuration: time.Minute, Namespace: "login"})
+		search := NewRateLimiter(mockStorage, Config{IPLimit: 1, BlockDuration: time.Minute, Namespace: "search"})
+
+		if decision, _ := login.Allow(ctx, ip, ""); !decision.Allowed || decision.Key != "login:"+ip {
+			t.Errorf("Expected login request to be allowed under its namespace, got %+v", decision)
+		}
+		if decision, _ := search.Allow(ctx, ip, ""); !decision.Allowed {
+			t.Errorf("Expected search request to be allowed, got %+v", decision)
+		}
+		if decision, _ := login.Allow(ctx, ip, ""); decision.Allowed {
+			t.Error("Expected second login request to be rejected")
+		}
+	})
+
+	t.Run("Allow returns a structured decision", func(t *testing.T) {
+		ip := "192.168.1.8"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, config)
+
+		decision, err := limiter.Allow(ctx, ip, "")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !decision.Allowed {
+			t.Error("Expected request to be allowed")
+		}
+		if decision.Limit != config.IPLimit {
+			t.Errorf("Expected limit %d, got %d", config.IPLimit, decision.Limit)
+		}
+		if decision.Remaining != config.IPLimit-1 {
+			t.Errorf("Expected %d remaining requests, got %d", config.IPLimit-1, decision.Remaining)
+		}
+		if decision.Key != ip || decision.Rule != RuleIP {
+			t.Errorf("Expected key %q and rule %q, got %q and %q", ip, RuleIP, decision.Key, decision.Rule)
+		}
+		if !decision.ResetAt.After(time.Now()) {
+			t.Errorf("Expected reset time in the future, got %v", decision.ResetAt)
+		}
+
+		for i := 1; i < config.IPLimit; i++ {
+			if _, err := limiter.Allow(ctx, ip, ""); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		}
+
+		decision, err = limiter.Allow(ctx, ip, "")
+		if err != nil {
+			t.Fatalf("Expected rejection without error, got %v", err)
+		}
+		if decision.Allowed || decision.Remaining != 0 {
+			t.Errorf("Expected request to be rejected with no remaining requests, got %+v", decision)
+		}
+		if decision.RetryAfter != config.BlockDuration {
+			t.Errorf("Expected retry after %v, got %v", config.BlockDuration, decision.RetryAfter)
+		}
+	})
+
+	t.Run("Errors can be told apart", func(t *testing.T) {
+		token := "abc789"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{TokenLimit: 1})
+
+		limiter.CheckLimit(ctx, "", token)
+		err := limiter.CheckLimit(ctx, "", token)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("Expected ErrLimitExceeded, got %v", err)
+		}
+		if errors.Is(err, ErrStorageUnavailable) {
+			t.Error("Expected limit rejection not to be a storage error")
+		}
+
+		limiter = NewRateLimiter(failingStorage{mockStorage}, Config{TokenLimit: 1})
+		_, err = limiter.Allow(ctx, "", token)
+		if !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("Expected ErrStorageUnavailable, got %v", err)
+		}
+
+		limiter = NewRateLimiter(failingStorage{mockStorage}, Config{TokenLimit: 1, Algorithm: GCRA})
+		_, err = limiter.Allow(ctx, "", token)
+		if !errors.Is(err, ErrUnsupportedAlgorithm) {
+			t.Errorf("Expected ErrUnsupportedAlgorithm, got %v", err)
+		}
+	})
+	t.Run("Failure policies", func(t *testing.T) {
+		ip := "192.168.1.9"
+		failing := failingStorage{storage.NewMockStorage()}
+
+		limiter = NewRateLimiter(failing, Config{IPLimit: 1})
+		if _, err := limiter.Allow(ctx, ip, ""); !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("Expected fail closed to return ErrStorageUnavailable, got %v", err)
+		}
+
+		var reported []error
+		limiter = NewRateLimiter(failing, Config{IPLimit: 1, FailurePolicy: FailOpen}, WithStorageErrorHook(func(err error) {
+			reported = append(reported, err)
+		}))
+		for i := 0; i < 3; i++ {
+			decision, err := limiter.Allow(ctx, ip, "")
+			if err != nil || !decision.Allowed {
+				t.Errorf("Expected fail open to allow request %d, got %+v and error %v", i+1, decision, err)
+			}
+		}
+		if len(reported) != 1 || !errors.Is(reported[0], ErrStorageUnavailable) {
+			t.Errorf("Expected the storage error to be reported once before retrying, got %v", reported)
+		}
+
+		limiter = NewRateLimiter(failing, Config{IPLimit: 1, FailurePolicy: FailLocal}, WithFallbackStorage(storage.NewMockStorage()))
+		if decision, err := limiter.Allow(ctx, ip, ""); err != nil || !decision.Allowed {
+			t.Errorf("Expected fallback storage to allow first request, got %+v and error %v", decision, err)
+		}
+		if decision, err := limiter.Allow(ctx, ip, ""); err != nil || decision.Allowed {
+			t.Errorf("Expected fallback storage to limit second request, got %+v and error %v", decision, err)
+		}
+	})
+	t.Run("IPv6 addresses of the same network share the limit", func(t *testing.T) {
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{IPLimit: 2, BlockDuration: time.Minute})
+
+		for i, ip := range []string{"2001:db8:1:1::1", "2001:db8:1:1::2"} {
+			decision, err := limiter.Allow(ctx, ip, "")
+			if err != nil || !decision.Allowed {
+				t.Errorf("Expected request %d to be allowed, got %+v and error %v", i+1, decision, err)
+			}
+			if decision.Key != "2001:db8:1:1::/64" {
+				t.Errorf("Expected key 2001:db8:1:1::/64, got %s", decision.Key)
+			}
+		}
+
+		if decision, _ := limiter.Allow(ctx, "2001:db8:1:1:ffff::3", ""); decision.Allowed {
+			t.Error("Expected rotated address within the /64 to be limited, but it was allowed")
+		}
+		if decision, _ := limiter.Allow(ctx, "2001:db8:1:2::1", ""); !decision.Allowed {
+			t.Error("Expected another /64 to have its own limit")
+		}
+		if decision, _ := limiter.Allow(ctx, "192.168.1.10", ""); decision.Key != "192.168.1.10" {
+			t.Errorf("Expected IPv4 key to be the address, got %s", decision.Key)
+		}
+	})
+
+	t.Run("Coarser prefixes have their own caps", func(t *testing.T) {
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, Config{
+			IPLimit:       2,
+			IPv4Prefix:    24,
+			BlockDuration: time.Minute,
+			PrefixLimits:  []PrefixLimit{{IPv4Prefix: 16, IPv6Prefix: 48, Limit: 3}},
+		})
+
+		for i, ip := range []string{"10.1.1.1", "10.1.1.2"} {
+			if decision, _ := limiter.Allow(ctx, ip, ""); !decision.Allowed {
+				t.Errorf("Expected request %d to be allowed", i+1)
+			}
+		}
+		if decision, _ := limiter.Allow(ctx, "10.1.1.3", ""); decision.Allowed || decision.Rule != RuleIP {
+			t.Errorf("Expected the /24 to be limited by the IP rule, got %+v", decision)
+		}
+
+		if decision, _ := limiter.Allow(ctx, "10.1.2.1", ""); !decision.Allowed {
+			t.Error("Expected another /24 to be allowed")
+		}
+		decision, _ := limiter.Allow(ctx, "10.1.3.1", "")
+		if decision.Allowed || decision.Rule != RuleIPPrefix || decision.Key != "net:10.1.0.0/16" {
+			t.Errorf("Expected the /16 cap to be reached, got %+v", decision)
+		}
+
+		for i, ip := range []string{"2001:db8:1:a::1", "2001:db8:1:b::1", "2001:db8:1:c::1"} {
+			if decision, _ := limiter.Allow(ctx, ip, ""); !decision.Allowed {
+				t.Errorf("Expected IPv6 request %d to be allowed", i+1)
+			}
+		}
+		if decision, _ := limiter.Allow(ctx, "2001:db8:1:d::1", ""); decision.Allowed {
+			t.Error("Expected the /48 cap to be reached, but request was allowed")
+		}
+	})
+	t.Run("Unknown tokens fall back to the IP limit", func(t *testing.T) {
+		ip := "192.168.1.11"
+
+		mockStorage = storage.NewMockStorage()
+		limiter = NewRateLimiter(mockStorage, config, WithTokenRegistry(tokens.NewMemoryRegistry("known")))
+
+		for i := 0; i < config.IPLimit; i++ {
+			decision, err := limiter.Allow(ctx, ip, fmt.Sprintf("random-%d", i))
+			if err != nil || !decision.Allowed {
+				t.Errorf("Expected request %d to be allowed, got %+v and error %v", i+1, decision, err)
+			}
+			if decision.Rule != RuleIP {
+				t.Errorf("Expected request %d to be limited by IP, got rule %s", i+1, decision.Rule)
+			}
+		}
+
+		if decision, _ := limiter.Allow(ctx, ip, "random-again"); decision.Allowed {
+			t.Error("Expected random tokens not to bypass the IP limit")
+		}
+		if decision, _ := limiter.Allow(ctx, ip, "known"); !decision.Allowed || decision.Rule != RuleToken {
+			t.Errorf("Expected known token to use the token limit, got %+v", decision)
+		}
+	})
+
+	t.Run("Unknown tokens can be rejected", func(t *testing.T) {
+		mockStorage = storage.NewMockStorage()
+		config := config
+		config.UnknownTokenPolicy = RejectUnknownTokens
+		limiter = NewRateLimiter(mockStorage, config, WithTokenRegistry(tokens.NewMemoryRegistry("known")))
+
+		if _, err := limiter.Allow(ctx, "192.168.1.12", "random"); !errors.Is(err, ErrUnknownToken) {
+			t.Errorf("Expected ErrUnknownToken, got %v", err)
+		}
+		if _, err := limiter.Allow(ctx, "192.168.1.12", "known"); err != nil {
+			t.Errorf("Expected known token to be accepted, got %v", err)
+		}
+	})
+	t.Run("Tokens fall back to the IP limit while the registry fails", func(t *testing.T) {
+		ip := "192.168.1.13"
+
+		for _, policy := range []UnknownTokenPolicy{LimitUnknownTokensByIP, RejectUnknownTokens} {
+			mockStorage = storage.NewMockStorage()
+			config := config
+			config.FailurePolicy = FailOpen
+			config.UnknownTokenPolicy = policy
+			limiter = NewRateLimiter(mockStorage, config, WithTokenRegistry(failingRegistry{}))
+
+			for i := 0; i < config.IPLimit; i++ {
+				decision, err := limiter.Allow(ctx, ip, fmt.Sprintf("random-%d", i))
+				if err != nil || !decision.Allowed || decision.Rule != RuleIP {
+					t.Errorf("%s: expected request %d to be allowed by the IP limit, got %+v and error %v", policy, i+1, decision, err)
+				}
+			}
+			if decision, err := limiter.Allow(ctx, ip, "random-again"); err != nil || decision.Allowed {
+				t.Errorf("%s: expected the IP limit to apply, got %+v and error %v", policy, decision, err)
+			}
+		}
+
+		limiter = NewRateLimiter(storage.NewMockStorage(), config, WithTokenRegistry(failingRegistry{}))
+		if _, err := limiter.Allow(ctx, ip, "random"); !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("Expected fail closed to return ErrStorageUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("Tokens use the policy of their tier", func(t *testing.T) {
+		mockStorage = storage.NewMockStorage()
+		policies := tokens.NewStaticPolicies(tokens.Tiers{
+			"free": {Limit: 2},
+			"pro":  {Limit: 5, Window: time.Minute, BlockDuration: time.Hour},
+		}, map[string]string{"free-token": "free", "pro-token": "pro"})
+		limiter = NewRateLimiter(mockStorage, config, WithTokenPolicies(policies))
+
+		for i := 0; i < 2; i++ {
+			if decision, _ := limiter.Allow(ctx, "", "free-token"); !decision.Allowed {
+				t.Errorf("Expected free request %d to be allowed", i+1)
+			}
+		}
+		if decision, _ := limiter.Allow(ctx, "", "free-token"); decision.Allowed || decision.RetryAfter != config.BlockDuration {
+			t.Errorf("Expected free tier to be limited with the default block duration, got %+v", decision)
+		}
+
+		for i := 0; i < 5; i++ {
+			if decision, _ := limiter.Allow(ctx, "", "pro-token"); !decision.Allowed || decision.Window != time.Minute {
+				t.Errorf("Expected pro request %d to be allowed within a minute window, got %+v", i+1, decision)
+			}
+		}
+		if decision, _ := limiter.Allow(ctx, "", "pro-token"); decision.Allowed || decision.RetryAfter != time.Hour {
+			t.Errorf("Expected pro tier to be blocked for an hour, got %+v", decision)
+		}
+
+		// Tokens without a policy use TokenLimit
+		for i := 0; i < config.TokenLimit; i++ {
+			if decision, _ := limiter.Allow(ctx, "", "other-token"); !decision.Allowed {
+				t.Errorf("Expected request %d to be allowed", i+1)
+			}
+		}
+		if decision, _ := limiter.Allow(ctx, "", "other-token"); decision.Allowed {
+			t.Error("Expected token without policy to be limited by TokenLimit")
+		}
+	})
+
+	t.Run("Tokens of unknown tiers use the default policy", func(t *testing.T) {
+		policies := tokens.NewStaticPolicies(tokens.Tiers{}, map[string]string{"lost-token": "platinum"})
+		var reported []error
+		limiter = NewRateLimiter(storage.NewMockStorage(), config, WithTokenPolicies(policies), WithStorageErrorHook(func(err error) {
+			reported = append(reported, err)
+		}))
+
+		for i := 0; i < config.TokenLimit; i++ {
+			decision, err := limiter.Allow(ctx, "", "lost-token")
+			if err != nil || !decision.Allowed || decision.Limit != config.TokenLimit {
+				t.Errorf("Expected request %d to be allowed by TokenLimit, got %+v and error %v", i+1, decision, err)
+			}
+		}
+		if decision, _ := limiter.Allow(ctx, "", "lost-token"); decision.Allowed {
+			t.Error("Expected the token to be limited by TokenLimit")
+		}
+		if len(reported) != 0 {
+			t.Errorf("Expected no storage error to be reported, got %v", reported)
+		}
+	})
+
+	t.Run("Repeat offenders are blocked for longer", func(t *testing.T) {
+		penaltyConfig := config
+		penaltyConfig.IPLimit = 1
+		penaltyConfig.BlockDuration = time.Minute
+		penaltyConfig.Penalty = Penalty{Multiplier: 2, MaxBlockDuration: 5 * time.Minute, Decay: time.Hour}
+
+		// Extra windows do not change how the limit of the key blocks it
+		windowsConfig := penaltyConfig
+		windowsConfig.IPWindows = []WindowLimit{{Limit: 100, Window: 24 * time.Hour}}
+
+		mockStorage = storage.NewMockStorage()
+		limiters := map[string]*RateLimiter{
+			"atomic":   NewRateLimiter(mockStorage, penaltyConfig),
+			"separate": NewRateLimiter(separateCallsStorage{mockStorage, mockStorage, mockStorage}, penaltyConfig),
+			"windows":  NewRateLimiter(mockStorage, windowsConfig),
+		}
+		for name, l := range limiters {
+			ip := "192.168.2.1-" + name
+			limiter = l
+
+			trip := func() time.Duration {
+				limiter.Allow(ctx, ip, "")
+				decision, err := limiter.Allow(ctx, ip, "")
+				if err != nil || decision.Allowed {
+					t.Fatalf("%s: expected the limit to be tripped, got %+v, %v", name, decision, err)
+				}
+				mockStorage.AdvanceTime(decision.RetryAfter + time.Second)
+				return decision.RetryAfter
+			}
+
+			for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+				if blocked := trip(); blocked != expected {
+					t.Errorf("%s: violation %d: expected a block of %v, got %v", name, i+1, expected, blocked)
+				}
+			}
+
+			// Violations are forgotten after the decay without tripping the limit
+			mockStorage.AdvanceTime(time.Hour)
+			if blocked := trip(); blocked != time.Minute {
+				t.Errorf("%s: expected the block duration to reset after the decay, got %v", name, blocked)
+			}
+		}
+	})
+
+	t.Run("Concurrent requests over the limit are a single violation", func(t *testing.T) {
+		ip := "192.168.2.2"
+		memoryStorage := storage.NewMemoryStorage()
+		defer memoryStorage.Close()
+
+		limiter = NewRateLimiter(slowWindowsStorage{memoryStorage}, Config{
+			IPLimit:       10,
+			BlockDuration: 5 * time.Minute,
+			IPWindows:     []WindowLimit{{Limit: 1000, Window: 24 * time.Hour}},
+			Penalty:       Penalty{Multiplier: 2},
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 200; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				limiter.Allow(ctx, ip, "")
+			}()
+		}
+		wg.Wait()
+
+		decision, err := limiter.Allow(ctx, ip, "")
+		if err != nil || decision.Allowed || decision.RetryAfter <= 0 || decision.RetryAfter > 5*time.Minute {
+			t.Errorf("Expected the key to be blocked for at most 5m, got %+v, %v", decision, err)
+		}
+	})
+}
+
+// slowWindowsStorage delays counting windows, like a storage across the network
+type slowWindowsStorage struct {
+	*storage.MemoryStorage
+}
+
+func (s slowWindowsStorage) IncrementWindows(ctx context.Context, key string, windows []storage.Window, cost int64, block storage.BlockPolicy) (storage.WindowsResult, error) {
+	time.Sleep(time.Millisecond)
+	return s.MemoryStorage.IncrementWindows(ctx, key, windows, cost, block)
+}
+
+// separateCallsStorage hides the atomic fixed window of a storage, so the limiter
+// checks, counts and blocks keys with separate calls
+type separateCallsStorage struct {
+	storage.Storage
+	storage.BlockTTLStorage
+	storage.ViolationStorage
 }
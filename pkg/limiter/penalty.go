@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// Penalty escalates the blocks of repeat offenders. Every violation within Decay
+// of the previous one multiplies the block duration by Multiplier, up to
+// MaxBlockDuration, so a key tripping the limit again right after its block
+// ends is blocked for longer each time
+type Penalty struct {
+	// Multiplier is applied to the block duration for every previous violation,
+	// penalties are disabled when it is zero
+	Multiplier float64
+
+	// MaxBlockDuration caps the block duration, unlimited when zero
+	MaxBlockDuration time.Duration
+
+	// Decay is how long a key must not trip the limit for its violations to be
+	// forgotten, defaults to 24 hours
+	Decay time.Duration
+}
+
+func (p Penalty) enabled() bool {
+	return p.Multiplier > 0
+}
+
+func (p Penalty) decay() time.Duration {
+	if p.Decay > 0 {
+		return p.Decay
+	}
+	return 24 * time.Hour
+}
+
+// blockPolicy returns how keys of a policy are blocked, escalated by the Penalty
+func (rl *RateLimiter) blockPolicy(p policy) storage.BlockPolicy {
+	block := storage.BlockPolicy{Duration: p.blockDuration}
+	if penalty := rl.config.Penalty; penalty.enabled() {
+		block.Multiplier = penalty.Multiplier
+		block.MaxDuration = penalty.MaxBlockDuration
+		block.Decay = penalty.decay()
+	}
+	return block
+}
+
+// penalize records a violation of a key and returns how long to block it
+func (rl *RateLimiter) penalize(ctx context.Context, key string, p policy) (time.Duration, error) {
+	block := rl.blockPolicy(p)
+	if !rl.config.Penalty.enabled() {
+		return block.Duration, nil
+	}
+
+	violationStorage, ok := rl.storage.(storage.ViolationStorage)
+	if !ok {
+		return 0, fmt.Errorf("%w: storage does not support penalties", ErrUnsupportedAlgorithm)
+	}
+
+	violations, err := violationStorage.AddViolation(ctx, key, block.Decay)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record %s violation: %w: %v", p.rule, ErrStorageUnavailable, err)
+	}
+	return block.For(violations), nil
+}
@@ -0,0 +1,195 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// QuotaPeriod is the calendar period a quota resets on
+type QuotaPeriod string
+
+const (
+	// Daily quotas reset at midnight
+	Daily QuotaPeriod = "daily"
+
+	// Monthly quotas reset at midnight on the first day of the month
+	Monthly QuotaPeriod = "monthly"
+)
+
+type QuotaConfig struct {
+	// Limit is the usage allowed per period
+	Limit int
+
+	// Period defaults to Daily
+	Period QuotaPeriod
+
+	// Location is the timezone periods are aligned to, defaults to UTC
+	Location *time.Location
+}
+
+// QuotaStatus describes the usage of a quota in the current period
+type QuotaStatus struct {
+	// Allowed reports whether the usage was consumed
+	Allowed bool
+
+	// Limit is the usage allowed per period
+	Limit int
+
+	// Used is the usage in the current period. It is negative when the quota was
+	// topped up by more than was used
+	Used int
+
+	// Remaining is the usage still available in the current period
+	Remaining int
+
+	// ResetAt is when the next period starts
+	ResetAt time.Time
+
+	// Key is the quota key, usually the tenant
+	Key string
+}
+
+// Quota limits the usage of keys over calendar periods, such as a day or a month,
+// for billing. Unlike RateLimiter, usage is never blocked beyond the period and
+// quotas can be reset or topped up
+type Quota struct {
+	storage   storage.Storage
+	usage     storage.QuotaStorage
+	config    QuotaConfig
+	locations func(key string) *time.Location
+	now       func() time.Time
+}
+
+// QuotaOption configures a Quota
+type QuotaOption func(*Quota)
+
+// WithQuotaLocations sets a function returning the timezone of a key, so each
+// tenant's periods follow its own midnight. A nil location uses Location
+func WithQuotaLocations(locations func(key string) *time.Location) QuotaOption {
+	return func(q *Quota) {
+		q.locations = locations
+	}
+}
+
+// NewQuota creates a Quota, failing when the storage does not keep quotas or
+// the period is unknown
+func NewQuota(s storage.Storage, config QuotaConfig, opts ...QuotaOption) (*Quota, error) {
+	quotaStorage, ok := s.(storage.QuotaStorage)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support quotas")
+	}
+
+	switch config.Period {
+	case "":
+		config.Period = Daily
+	case Daily, Monthly:
+	default:
+		return nil, fmt.Errorf("unsupported quota period %q", config.Period)
+	}
+
+	if config.Location == nil {
+		config.Location = time.UTC
+	}
+
+	q := &Quota{
+		storage: s,
+		usage:   quotaStorage,
+		config:  config,
+		now:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q, nil
+}
+
+// Consume uses amount of the quota of a key. The usage is not consumed, and
+// QuotaStatus.Allowed is false, when it would exceed the limit
+func (q *Quota) Consume(ctx context.Context, key string, amount int) (QuotaStatus, error) {
+	if amount < 0 {
+		return QuotaStatus{}, fmt.Errorf("quota amount must not be negative, use TopUp")
+	}
+	return q.consume(ctx, key, amount)
+}
+
+// TopUp gives amount back to the quota of a key for the current period
+func (q *Quota) TopUp(ctx context.Context, key string, amount int) (QuotaStatus, error) {
+	if amount < 0 {
+		return QuotaStatus{}, fmt.Errorf("quota top up must not be negative")
+	}
+	return q.consume(ctx, key, -amount)
+}
+
+// Status returns the usage of a key in the current period without consuming it
+func (q *Quota) Status(ctx context.Context, key string) (QuotaStatus, error) {
+	storageKey, resetAt := q.period(key)
+	used, err := q.usage.QuotaUsage(ctx, storageKey)
+	if err != nil {
+		return QuotaStatus{}, fmt.Errorf("failed to get quota usage: %w: %v", ErrStorageUnavailable, err)
+	}
+	return q.status(key, used, true, resetAt), nil
+}
+
+// Reset clears the usage of a key in the current period
+func (q *Quota) Reset(ctx context.Context, key string) error {
+	storageKey, _ := q.period(key)
+	if err := q.storage.Reset(ctx, storageKey); err != nil {
+		return fmt.Errorf("failed to reset quota: %w: %v", ErrStorageUnavailable, err)
+	}
+	return nil
+}
+
+func (q *Quota) consume(ctx context.Context, key string, amount int) (QuotaStatus, error) {
+	storageKey, resetAt := q.period(key)
+	used, consumed, err := q.usage.ConsumeQuota(ctx, storageKey, int64(amount), int64(q.config.Limit), resetAt)
+	if err != nil {
+		return QuotaStatus{}, fmt.Errorf("failed to consume quota: %w: %v", ErrStorageUnavailable, err)
+	}
+	return q.status(key, used, consumed, resetAt), nil
+}
+
+func (q *Quota) status(key string, used int64, allowed bool, resetAt time.Time) QuotaStatus {
+	remaining := q.config.Limit - int(used)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return QuotaStatus{
+		Allowed:   allowed,
+		Limit:     q.config.Limit,
+		Used:      int(used),
+		Remaining: remaining,
+		ResetAt:   resetAt,
+		Key:       key,
+	}
+}
+
+// period returns the storage key of the current period of a key and when the
+// period ends. The key names the period, so a new period starts from zero even
+// if the previous key has not expired yet
+func (q *Quota) period(key string) (string, time.Time) {
+	location := q.config.Location
+	if q.locations != nil {
+		if l := q.locations(key); l != nil {
+			location = l
+		}
+	}
+
+	now := q.now().In(location)
+	year, month, day := now.Date()
+
+	var start, end time.Time
+	switch q.config.Period {
+	case Monthly:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, location)
+		end = start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(year, month, day, 0, 0, 0, 0, location)
+		end = start.AddDate(0, 0, 1)
+	}
+
+	return fmt.Sprintf("quota:%s:%s", start.Format("2006-01-02T15:04:05Z07:00"), key), end
+}
@@ -0,0 +1,95 @@
+package limiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Daily quotas reset at midnight", func(t *testing.T) {
+		mockStorage := storage.NewMockStorage()
+		quota, err := NewQuota(mockStorage, QuotaConfig{Limit: 3})
+		if err != nil {
+			t.Fatalf("Failed to create quota: %v", err)
+		}
+		now := time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC)
+		mockStorage.SetCurrentTime(now)
+		quota.now = func() time.Time { return now }
+
+		status, _ := quota.Consume(ctx, "tenant", 2)
+		if !status.Allowed || status.Remaining != 1 || !status.ResetAt.Equal(time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Expected usage to be consumed until midnight, got %+v", status)
+		}
+
+		// Usage that would exceed the limit is not consumed
+		status, _ = quota.Consume(ctx, "tenant", 2)
+		if status.Allowed || status.Used != 2 {
+			t.Errorf("Expected usage over the limit to be rejected, got %+v", status)
+		}
+
+		now = now.Add(time.Hour)
+		mockStorage.SetCurrentTime(now)
+		status, _ = quota.Status(ctx, "tenant")
+		if status.Used != 0 || status.Remaining != 3 {
+			t.Errorf("Expected a new day to start from zero, got %+v", status)
+		}
+	})
+
+	t.Run("Monthly quotas follow the tenant timezone", func(t *testing.T) {
+		saoPaulo := time.FixedZone("BRT", -3*60*60)
+		quota, err := NewQuota(storage.NewMockStorage(), QuotaConfig{Limit: 10, Period: Monthly},
+			WithQuotaLocations(func(key string) *time.Location {
+				if key == "br-tenant" {
+					return saoPaulo
+				}
+				return nil
+			}))
+		if err != nil {
+			t.Fatalf("Failed to create quota: %v", err)
+		}
+		// Already April in UTC, still March in Sao Paulo
+		quota.now = func() time.Time { return time.Date(2024, 4, 1, 1, 0, 0, 0, time.UTC) }
+
+		status, _ := quota.Consume(ctx, "br-tenant", 1)
+		if !status.ResetAt.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, saoPaulo)) {
+			t.Errorf("Expected the quota to reset on April 1st in Sao Paulo, got %v", status.ResetAt)
+		}
+
+		status, _ = quota.Consume(ctx, "us-tenant", 1)
+		if !status.ResetAt.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Expected the quota to reset on May 1st in UTC, got %v", status.ResetAt)
+		}
+	})
+
+	t.Run("Quotas can be topped up and reset", func(t *testing.T) {
+		quota, err := NewQuota(storage.NewMockStorage(), QuotaConfig{Limit: 2})
+		if err != nil {
+			t.Fatalf("Failed to create quota: %v", err)
+		}
+
+		quota.Consume(ctx, "tenant", 2)
+		status, _ := quota.TopUp(ctx, "tenant", 3)
+		if status.Used != -1 || status.Remaining != 3 {
+			t.Errorf("Expected the top up to add to the remaining quota, got %+v", status)
+		}
+
+		if err := quota.Reset(ctx, "tenant"); err != nil {
+			t.Fatalf("Failed to reset quota: %v", err)
+		}
+		status, _ = quota.Status(ctx, "tenant")
+		if status.Used != 0 || status.Remaining != 2 {
+			t.Errorf("Expected the reset quota to be full, got %+v", status)
+		}
+	})
+
+	t.Run("Unknown periods are rejected", func(t *testing.T) {
+		if _, err := NewQuota(storage.NewMockStorage(), QuotaConfig{Limit: 1, Period: "weekly"}); err == nil {
+			t.Error("Expected an error for an unknown period")
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/tokens"
+)
+
+// ErrUnknownToken is returned when a request carries a token that is not in the
+// registry and RejectUnknownTokens is set
+var ErrUnknownToken = errors.New("unknown API token")
+
+// UnknownTokenPolicy decides how requests with unregistered tokens are limited
+type UnknownTokenPolicy string
+
+const (
+	// LimitUnknownTokensByIP ignores unknown tokens and applies the IP limit
+	LimitUnknownTokensByIP UnknownTokenPolicy = "ip"
+
+	// RejectUnknownTokens rejects requests with unknown tokens with ErrUnknownToken
+	RejectUnknownTokens UnknownTokenPolicy = "reject"
+)
+
+// WithTokenRegistry validates tokens against a registry before the token limit
+// is applied. Without a registry every token is accepted
+func WithTokenRegistry(registry tokens.Registry) Option {
+	return func(rl *RateLimiter) {
+		rl.registry = registry
+	}
+}
+
+// WithTokenPolicies looks up the limit, window and block duration of each token,
+// falling back to TokenLimit, Window and BlockDuration for the fields a policy
+// leaves empty and for tokens without a policy
+func WithTokenPolicies(source tokens.PolicySource) Option {
+	return func(rl *RateLimiter) {
+		rl.policies = source
+	}
+}
+
+// tokenPolicy returns the policy of a token. Lookup failures are handled like
+// storage failures: only FailClosed turns them into errors, otherwise the
+// default token policy is used. Tokens assigned to an unknown tier are a
+// configuration mistake, not an outage, so they always get the default policy
+func (rl *RateLimiter) tokenPolicy(ctx context.Context, token string) (policy, error) {
+	p := rl.policy(RuleToken, rl.config.TokenLimit)
+	if rl.policies == nil {
+		return p, nil
+	}
+
+	tokenPolicy, found, err := rl.policies.Policy(ctx, token)
+	if errors.Is(err, tokens.ErrUnknownTier) {
+		log.Printf("using the default token policy: %v", err)
+		return p, nil
+	} else if err != nil {
+		return p, rl.lookupFailed(fmt.Errorf("failed to get token policy: %w: %v", ErrStorageUnavailable, err))
+	}
+
+	if found {
+		if tokenPolicy.Limit > 0 {
+			p.limit = tokenPolicy.Limit
+		}
+		if tokenPolicy.Window > 0 {
+			p.window = tokenPolicy.Window
+		}
+		if tokenPolicy.BlockDuration > 0 {
+			p.blockDuration = tokenPolicy.BlockDuration
+		}
+	}
+	return p, nil
+}
+
+// knownToken reports whether the token is in the registry and whether the registry
+// could be checked at all. Registry failures are handled like storage failures:
+// only FailClosed turns them into errors, otherwise the token is not known, so it
+// cannot bypass the IP limit, nor unknown, so it is not rejected during an outage
+func (rl *RateLimiter) knownToken(ctx context.Context, token string) (known, checked bool, err error) {
+	if rl.registry == nil {
+		return true, true, nil
+	}
+
+	known, err = rl.registry.Exists(ctx, token)
+	if err != nil {
+		return false, false, rl.lookupFailed(fmt.Errorf("failed to check token registry: %w: %v", ErrStorageUnavailable, err))
+	}
+	return known, true, nil
+}
+
+// lookupFailed reports a failed token lookup and returns the error only when
+// the failure policy is FailClosed
+func (rl *RateLimiter) lookupFailed(err error) error {
+	if rl.onStorageError != nil {
+		rl.onStorageError(err)
+	}
+	if rl.failurePolicy() == FailClosed {
+		return err
+	}
+	return nil
+}
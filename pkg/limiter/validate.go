@@ -0,0 +1,124 @@
+package limiter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// Validate reports every invalid or missing field of the configuration at once,
+// joined with errors.Join. Zero values that have a default, such as Window or
+// Algorithm, are valid
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.IPLimit <= 0 {
+		invalid("IPLimit must be positive, got %d", c.IPLimit)
+	}
+	if c.TokenLimit <= 0 {
+		invalid("TokenLimit must be positive, got %d", c.TokenLimit)
+	}
+
+	switch c.Algorithm {
+	case "", FixedWindow:
+		// A zero block duration would block keys forever in Redis
+		if c.BlockDuration <= 0 {
+			invalid("BlockDuration must be positive with the %s algorithm, got %v", FixedWindow, c.BlockDuration)
+		}
+	case TokenBucket, SlidingWindowLog, SlidingWindowCounter, GCRA:
+		if c.BlockDuration < 0 {
+			invalid("BlockDuration must not be negative, got %v", c.BlockDuration)
+		}
+		if len(c.IPWindows) > 0 || len(c.TokenWindows) > 0 {
+			invalid("IPWindows and TokenWindows require the %s algorithm, got %s", FixedWindow, c.Algorithm)
+		}
+		if c.Penalty.enabled() {
+			invalid("Penalty requires the %s algorithm, got %s", FixedWindow, c.Algorithm)
+		}
+	default:
+		invalid("Algorithm %q is not supported", c.Algorithm)
+	}
+
+	if c.Window < 0 {
+		invalid("Window must not be negative, got %v", c.Window)
+	}
+	if c.Burst < 0 {
+		invalid("Burst must not be negative, got %d", c.Burst)
+	}
+	if c.RefillRate < 0 {
+		invalid("RefillRate must not be negative, got %v", c.RefillRate)
+	}
+
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		invalid("IPv4Prefix must be between 0 and 32, got %d", c.IPv4Prefix)
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		invalid("IPv6Prefix must be between 0 and 128, got %d", c.IPv6Prefix)
+	}
+	for i, prefixLimit := range c.PrefixLimits {
+		if prefixLimit.Limit <= 0 {
+			invalid("PrefixLimits[%d].Limit must be positive, got %d", i, prefixLimit.Limit)
+		}
+		if prefixLimit.IPv4Prefix < 0 || prefixLimit.IPv4Prefix > 32 {
+			invalid("PrefixLimits[%d].IPv4Prefix must be between 0 and 32, got %d", i, prefixLimit.IPv4Prefix)
+		}
+		if prefixLimit.IPv6Prefix < 0 || prefixLimit.IPv6Prefix > 128 {
+			invalid("PrefixLimits[%d].IPv6Prefix must be between 0 and 128, got %d", i, prefixLimit.IPv6Prefix)
+		}
+	}
+
+	// Checked in a fixed order, so the errors read the same on every run
+	for _, windows := range []struct {
+		name   string
+		limits []WindowLimit
+	}{{"IPWindows", c.IPWindows}, {"TokenWindows", c.TokenWindows}} {
+		for i, window := range windows.limits {
+			if window.Limit <= 0 {
+				invalid("%s[%d].Limit must be positive, got %d", windows.name, i, window.Limit)
+			}
+			if window.Window <= 0 {
+				invalid("%s[%d].Window must be positive, got %v", windows.name, i, window.Window)
+			}
+		}
+	}
+
+	if c.Penalty.Multiplier != 0 && c.Penalty.Multiplier < 1 {
+		invalid("Penalty.Multiplier must be at least 1, got %v", c.Penalty.Multiplier)
+	}
+	if c.Penalty.MaxBlockDuration < 0 {
+		invalid("Penalty.MaxBlockDuration must not be negative, got %v", c.Penalty.MaxBlockDuration)
+	}
+	if c.Penalty.Decay < 0 {
+		invalid("Penalty.Decay must not be negative, got %v", c.Penalty.Decay)
+	}
+
+	switch c.UnknownTokenPolicy {
+	case "", LimitUnknownTokensByIP, RejectUnknownTokens:
+	default:
+		invalid("UnknownTokenPolicy %q is not supported, use %q or %q", c.UnknownTokenPolicy, LimitUnknownTokensByIP, RejectUnknownTokens)
+	}
+
+	switch c.FailurePolicy {
+	case "", FailClosed, FailOpen, FailLocal:
+	default:
+		invalid("FailurePolicy %q is not supported, use %q, %q or %q", c.FailurePolicy, FailClosed, FailOpen, FailLocal)
+	}
+	if c.StorageRetryInterval < 0 {
+		invalid("StorageRetryInterval must not be negative, got %v", c.StorageRetryInterval)
+	}
+
+	return errors.Join(errs...)
+}
+
+// NewValidatedRateLimiter is NewRateLimiter for configurations read at runtime,
+// it returns the errors of config.Validate instead of a misconfigured limiter
+func NewValidatedRateLimiter(storage storage.Storage, config Config, opts ...Option) (*RateLimiter, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limiter configuration:\n%w", err)
+	}
+	return NewRateLimiter(storage, config, opts...), nil
+}
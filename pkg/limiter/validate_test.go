@@ -0,0 +1,102 @@
+package limiter
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{IPLimit: 10, TokenLimit: 100, BlockDuration: time.Minute}
+
+	t.Run("Valid configs", func(t *testing.T) {
+		configs := []Config{
+			valid,
+			{IPLimit: 10, TokenLimit: 100, Algorithm: TokenBucket},
+			{IPLimit: 10, TokenLimit: 100, BlockDuration: time.Minute, IPWindows: []WindowLimit{{Limit: 100, Window: time.Hour}}},
+			{IPLimit: 10, TokenLimit: 100, BlockDuration: time.Minute, TokenWindows: []WindowLimit{{Limit: 100, Window: time.Hour}}, Penalty: Penalty{Multiplier: 2}},
+		}
+		for _, config := range configs {
+			if err := config.Validate(); err != nil {
+				t.Errorf("Expected %+v to be valid, got %v", config, err)
+			}
+		}
+	})
+
+	t.Run("Every invalid field is reported", func(t *testing.T) {
+		config := Config{
+			IPLimit:            -1,
+			Window:             -time.Second,
+			IPv4Prefix:         33,
+			PrefixLimits:       []PrefixLimit{{IPv4Prefix: 24}},
+			TokenWindows:       []WindowLimit{{Limit: 10}},
+			Penalty:            Penalty{Multiplier: 0.5},
+			UnknownTokenPolicy: "allow",
+			FailurePolicy:      "sometimes",
+		}
+
+		err := config.Validate()
+		if err == nil {
+			t.Fatal("Expected an invalid config")
+		}
+
+		expected := []string{
+			"IPLimit must be positive",
+			"TokenLimit must be positive",
+			"BlockDuration must be positive",
+			"Window must not be negative",
+			"IPv4Prefix must be between 0 and 32",
+			"PrefixLimits[0].Limit must be positive",
+			"TokenWindows[0].Window must be positive",
+			"Penalty.Multiplier must be at least 1",
+			"UnknownTokenPolicy \"allow\" is not supported",
+			"FailurePolicy \"sometimes\" is not supported",
+		}
+		for _, message := range expected {
+			if !strings.Contains(err.Error(), message) {
+				t.Errorf("Expected %q to be reported, got:\n%v", message, err)
+			}
+		}
+	})
+
+	t.Run("Errors are reported in a fixed order", func(t *testing.T) {
+		config := valid
+		config.IPWindows = []WindowLimit{{Limit: 10}}
+		config.TokenWindows = []WindowLimit{{Limit: 10}}
+
+		message := config.Validate().Error()
+		for i := 0; i < 10; i++ {
+			if again := config.Validate().Error(); again != message {
+				t.Fatalf("Expected the same errors on every run, got:\n%v\nthen:\n%v", message, again)
+			}
+		}
+		if strings.Index(message, "IPWindows") > strings.Index(message, "TokenWindows") {
+			t.Errorf("Expected IPWindows to be reported before TokenWindows, got:\n%v", message)
+		}
+	})
+
+	t.Run("Windows require the fixed window", func(t *testing.T) {
+		config := valid
+		config.Algorithm = GCRA
+		config.IPWindows = []WindowLimit{{Limit: 100, Window: time.Hour}}
+		if err := config.Validate(); err == nil {
+			t.Error("Expected windows to be rejected with GCRA")
+		}
+
+		config.Algorithm = "leaky_bucket"
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "leaky_bucket") {
+			t.Errorf("Expected an unknown algorithm to be reported, got %v", err)
+		}
+	})
+
+	t.Run("Invalid configs create no limiter", func(t *testing.T) {
+		if _, err := NewValidatedRateLimiter(storage.NewMockStorage(), Config{}); err == nil {
+			t.Error("Expected an error for an empty config")
+		}
+		if _, err := NewValidatedRateLimiter(storage.NewMockStorage(), valid); err != nil {
+			t.Errorf("Expected a limiter, got %v", err)
+		}
+	})
+}
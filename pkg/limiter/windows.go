@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// WindowLimit is a limit of requests over a period, such as 300 per minute
+type WindowLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// checkWindows counts the request in the window of the policy and in its extra
+// windows at once. The request is rejected until the reset of the first window
+// it would exceed, which is reported in the Decision. A key already at the limit
+// of the window of the policy is also blocked, like without extra windows, while
+// the extra windows never block. The block check, the counters, the violation and
+// the block are a single storage call, so concurrent requests trip the limit once
+func (rl *RateLimiter) checkWindows(ctx context.Context, key string, p policy, cost int) (Decision, error) {
+	windowStorage, ok := rl.storage.(storage.MultiWindowStorage)
+	if !ok {
+		return Decision{}, fmt.Errorf("%w: storage does not support multiple windows", ErrUnsupportedAlgorithm)
+	}
+
+	windows := make([]storage.Window, 0, len(p.windows)+1)
+	windows = append(windows, storage.Window{Limit: int64(p.limit), Period: p.window})
+	for _, window := range p.windows {
+		windows = append(windows, storage.Window{Limit: int64(window.Limit), Period: window.Window})
+	}
+
+	result, err := windowStorage.IncrementWindows(ctx, key, windows, int64(cost), rl.blockPolicy(p))
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to increment %s counters: %w: %v", p.rule, ErrStorageUnavailable, err)
+	}
+
+	if result.Blocked > 0 {
+		return newDecision(key, p.rule, p.limit, p.window, storage.Result{
+			RetryAfter: result.Blocked,
+			ResetAfter: result.Blocked,
+		}), nil
+	}
+
+	counts := result.Counts
+	if exceeded := result.Exceeded; exceeded >= 0 {
+		return newDecision(key, p.rule, int(windows[exceeded].Limit), windows[exceeded].Period, storage.Result{
+			RetryAfter: counts[exceeded].ResetAfter,
+			ResetAfter: counts[exceeded].ResetAfter,
+		}), nil
+	}
+
+	// Report the window closest to its limit
+	tightest := 0
+	for i := range windows {
+		if windows[i].Limit-counts[i].Count < windows[tightest].Limit-counts[tightest].Count {
+			tightest = i
+		}
+	}
+
+	return newDecision(key, p.rule, int(windows[tightest].Limit), windows[tightest].Period, storage.Result{
+		Allowed:    true,
+		Remaining:  windows[tightest].Limit - counts[tightest].Count,
+		ResetAfter: counts[tightest].ResetAfter,
+	}), nil
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/access"
+)
+
+// WithAllowlist lets the requests matching the list bypass every rate limit,
+// such as internal monitoring and partner networks
+func WithAllowlist(list access.List) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.allowlist = list
+	}
+}
+
+// WithDenylist rejects the requests matching the list with 403 Forbidden before
+// any rate limit, without counting them. It takes precedence over the allowlist
+func WithDenylist(list access.List) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.denylist = list
+	}
+}
+
+// listed reports whether a request matches a list. Lists that fail are logged
+// and treated as not matching, so requests are still rate limited
+func listed(list access.List, r *http.Request, ip, token string) bool {
+	if list == nil {
+		return false
+	}
+
+	matched, err := list.Contains(r.Context(), access.Request{IP: ip, Token: token, Header: r.Header})
+	if err != nil {
+		log.Printf("failed to check access list: %v", err)
+		return false
+	}
+	return matched
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/access"
+)
+
+// ClientIPResolver extracts the address of the client that sent a request
+type ClientIPResolver interface {
+	ClientIP(r *http.Request) string
+}
+
+// IPResolver resolves the client IP from the connection address. Forwarding
+// headers are only read when the connection comes from a trusted proxy, and
+// proxy chains are walked from the right so clients cannot spoof their address
+type IPResolver struct {
+	trustedProxies []*net.IPNet
+	headers        []string
+}
+
+// NewIPResolver creates an IPResolver trusting the given proxy addresses or CIDRs.
+// Headers are checked in order and may be "Forwarded", "X-Forwarded-For" or
+// "X-Real-IP", defaulting to X-Forwarded-For
+func NewIPResolver(trustedProxies []string, headers ...string) (*IPResolver, error) {
+	resolver := &IPResolver{headers: headers}
+	if len(resolver.headers) == 0 {
+		resolver.headers = []string{"X-Forwarded-For"}
+	}
+
+	for _, header := range resolver.headers {
+		switch http.CanonicalHeaderKey(header) {
+		case "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+		default:
+			return nil, fmt.Errorf("unsupported client IP header %q", header)
+		}
+	}
+
+	for _, proxy := range trustedProxies {
+		network, err := access.ParseNetwork(strings.TrimSpace(proxy))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		resolver.trustedProxies = append(resolver.trustedProxies, network)
+	}
+
+	return resolver, nil
+}
+
+func (res *IPResolver) ClientIP(r *http.Request) string {
+	remote := access.ParseIP(r.RemoteAddr)
+	if remote == nil {
+		return r.RemoteAddr
+	}
+
+	if !res.trusted(remote) {
+		return remote.String()
+	}
+
+	for _, header := range res.headers {
+		var hops []string
+		switch http.CanonicalHeaderKey(header) {
+		case "Forwarded":
+			hops = forwardedFor(r.Header.Values("Forwarded"))
+		case "X-Forwarded-For":
+			hops = splitList(r.Header.Values("X-Forwarded-For"))
+		case "X-Real-Ip":
+			hops = splitList(r.Header.Values("X-Real-IP"))
+		}
+
+		if ip := res.walk(hops); ip != nil {
+			return ip.String()
+		}
+	}
+
+	return remote.String()
+}
+
+// walk returns the rightmost hop not added by a trusted proxy. When every hop is
+// trusted the leftmost one is the client
+func (res *IPResolver) walk(hops []string) net.IP {
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := access.ParseIP(hops[i])
+		if ip == nil {
+			// The hop was written by a trusted proxy but is not an address
+			break
+		}
+
+		client = ip
+		if !res.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (res *IPResolver) trusted(ip net.IP) bool {
+	for _, network := range res.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithClientIPResolver sets how the middleware finds the client IP. By default
+// only the connection address is used
+func WithClientIPResolver(resolver ClientIPResolver) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.ipResolver = resolver
+	}
+}
+
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// forwardedFor returns the "for" parameter of every element of RFC 7239 Forwarded headers
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, element := range splitList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				hops = append(hops, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPResolver(t *testing.T) {
+	resolver, err := NewIPResolver([]string{"10.0.0.0/8", "2001:db8::1"}, "Forwarded", "X-Forwarded-For", "X-Real-IP")
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"Port is stripped from the connection address", "203.0.113.7:54321", nil, "203.0.113.7"},
+		{"IPv6 connection address", "[2001:db8::7]:443", nil, "2001:db8::7"},
+		{"Headers from untrusted clients are ignored", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "203.0.113.7"},
+		{"X-Forwarded-For from a trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"Spoofed X-Forwarded-For entries are skipped", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"Only trusted hops returns the leftmost one", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"Garbage hop stops the walk", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"Forwarded header", "10.0.0.1:1234", map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`}, "198.51.100.1"},
+		{"Forwarded header takes precedence", "[2001:db8::1]:80", map[string]string{"Forwarded": "for=198.51.100.2", "X-Forwarded-For": "198.51.100.3"}, "198.51.100.2"},
+		{"X-Real-IP from a trusted proxy", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.4"}, "198.51.100.4"},
+		{"No header falls back to the connection address", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			if ip := resolver.ClientIP(req); ip != tt.expected {
+				t.Errorf("Expected client IP %s, got %s", tt.expected, ip)
+			}
+		})
+	}
+
+	t.Run("Invalid configuration", func(t *testing.T) {
+		if _, err := NewIPResolver([]string{"not-a-cidr"}); err == nil {
+			t.Error("Expected error for invalid trusted proxy")
+		}
+		if _, err := NewIPResolver(nil, "X-Client-IP"); err == nil {
+			t.Error("Expected error for unsupported header")
+		}
+	})
+}
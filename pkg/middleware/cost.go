@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CostFunc returns how many requests a request counts as, so batch endpoints and
+// expensive queries consume more of the limit
+type CostFunc func(r *http.Request) int
+
+// WithCostFunc sets the cost of each request. By default every request costs 1,
+// and costs below 1 count as 1
+func WithCostFunc(cost CostFunc) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.cost = cost
+	}
+}
+
+// RouteCosts returns a CostFunc from a map of routes to costs. Routes are paths
+// optionally preceded by a method, such as "POST /batch" or "/search". As with
+// http.ServeMux, a path ending in a slash matches every path below it and the
+// longest match wins. Requests matching no route cost 1, as do routes with a
+// cost below 1
+func RouteCosts(costs map[string]int) CostFunc {
+	routes := make([]costRoute, 0, len(costs))
+	for pattern, cost := range costs {
+		method, path, found := strings.Cut(pattern, " ")
+		if !found {
+			method, path = "", pattern
+		}
+		routes = append(routes, costRoute{method: method, path: strings.TrimSpace(path), cost: atLeastOne(cost)})
+	}
+
+	return func(r *http.Request) int {
+		var best *costRoute
+		for i := range routes {
+			route := &routes[i]
+			if !route.matches(r) {
+				continue
+			}
+
+			// Routes with a method win over the same path without one
+			if best == nil || len(route.path) > len(best.path) ||
+				len(route.path) == len(best.path) && route.method != "" {
+				best = route
+			}
+		}
+
+		if best == nil {
+			return 1
+		}
+		return best.cost
+	}
+}
+
+type costRoute struct {
+	method string
+	path   string
+	cost   int
+}
+
+func (route *costRoute) matches(r *http.Request) bool {
+	if route.method != "" && route.method != r.Method {
+		return false
+	}
+	return r.URL.Path == route.path ||
+		strings.HasSuffix(route.path, "/") && strings.HasPrefix(r.URL.Path, route.path)
+}
+
+// atLeastOne clamps a cost to 1, as the limiter rejects lower costs
+func atLeastOne(cost int) int {
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteCosts(t *testing.T) {
+	cost := RouteCosts(map[string]int{
+		"/search":          5,
+		"/batch/":          10,
+		"POST /batch/":     20,
+		"/batch/small":     2,
+		"DELETE /accounts": 50,
+		"/free":            0,
+		"/negative":        -3,
+	})
+
+	tests := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{"GET", "/search", 5},
+		{"GET", "/search/more", 1},
+		{"GET", "/batch/orders", 10},
+		{"POST", "/batch/orders", 20},
+		{"POST", "/batch/small", 2},
+		{"GET", "/accounts", 1},
+		{"DELETE", "/accounts", 50},
+		{"GET", "/", 1},
+		{"GET", "/free", 1},
+		{"GET", "/negative", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if got := cost(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.expected {
+				t.Errorf("Expected cost %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
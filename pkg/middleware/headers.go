@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
+)
+
+// HeaderStyle selects which rate limit headers are sent to clients
+type HeaderStyle int
+
+const (
+	// LegacyHeaders sends X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset, the reset being a Unix timestamp
+	LegacyHeaders HeaderStyle = iota
+
+	// IETFHeaders sends the RateLimit-Policy and RateLimit structured fields from
+	// the IETF httpapi rate limit headers draft
+	IETFHeaders
+
+	// NoHeaders sends no rate limit headers besides Retry-After
+	NoHeaders
+)
+
+// WithHeaderStyle sets the rate limit headers sent on every response
+func WithHeaderStyle(style HeaderStyle) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.headerStyle = style
+	}
+}
+
+func writeRateLimitHeaders(h http.Header, style HeaderStyle, decision limiter.Decision) {
+	resetIn := decision.ResetAt.Sub(time.Now())
+	if resetIn < 0 {
+		resetIn = 0
+	}
+
+	switch style {
+	case LegacyHeaders:
+		h.Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(decision.ResetAt.Unix(), 10))
+	case IETFHeaders:
+		policy := strings.ToLower(decision.Rule)
+		h.Set("RateLimit-Policy", fmt.Sprintf("%q;q=%d;w=%d", policy, decision.Limit, seconds(decision.Window)))
+		h.Set("RateLimit", fmt.Sprintf("%q;r=%d;t=%d", policy, decision.Remaining, seconds(resetIn)))
+	}
+
+	if !decision.Allowed {
+		retryAfter := seconds(decision.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		h.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+}
+
+// seconds rounds a duration up to whole seconds, as required by the headers
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
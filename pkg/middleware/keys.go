@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// KeyExtractor extracts the identity a request is limited by, such as an API
+// key, a user ID or a session. Requests without an identity are limited by IP
+type KeyExtractor interface {
+	// Key returns the identity of the request and whether the request has one
+	Key(r *http.Request) (string, bool)
+}
+
+// KeyExtractorFunc adapts a function to the KeyExtractor interface
+type KeyExtractorFunc func(r *http.Request) (string, bool)
+
+func (f KeyExtractorFunc) Key(r *http.Request) (string, bool) {
+	return f(r)
+}
+
+// WithKeyExtractor sets how the middleware identifies requests. By default the
+// API_KEY header is used
+func WithKeyExtractor(extractor KeyExtractor) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.keyExtractor = extractor
+	}
+}
+
+// TokenKey marks the keys of an extractor as API tokens, checked against the
+// token registry of the limiter. The keys of HeaderKey and BearerToken are
+// tokens, the keys of the other extractors are identities such as sessions or
+// routes, which the registry does not know
+func TokenKey(extractor KeyExtractor) KeyExtractor {
+	return tokenKey{extractor}
+}
+
+type tokenKey struct {
+	KeyExtractor
+}
+
+// isTokenKey reports whether the keys of an extractor are API tokens
+func isTokenKey(extractor KeyExtractor) bool {
+	_, ok := extractor.(tokenKey)
+	return ok
+}
+
+// HeaderKey uses the value of a request header as an API token
+func HeaderKey(name string) KeyExtractor {
+	return TokenKey(KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		return nonEmpty(r.Header.Get(name))
+	}))
+}
+
+// BearerToken uses the token of an "Authorization: Bearer" header
+func BearerToken() KeyExtractor {
+	return TokenKey(KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return "", false
+		}
+		return nonEmpty(strings.TrimSpace(token))
+	}))
+}
+
+// QueryKey uses the value of a query string parameter
+func QueryKey(param string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		return nonEmpty(r.URL.Query().Get(param))
+	})
+}
+
+// CookieKey uses the value of a cookie
+func CookieKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return "", false
+		}
+		return nonEmpty(cookie.Value)
+	})
+}
+
+// PathParam uses a segment of the URL path matched by a pattern such as
+// "/tenants/{tenant}/orders", where name is "tenant". Paths may be longer than
+// the pattern, so the example also matches "/tenants/acme/orders/42"
+func PathParam(pattern, name string) KeyExtractor {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	placeholder := "{" + name + "}"
+
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		pathSegments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(pathSegments) < len(patternSegments) {
+			return "", false
+		}
+
+		var value string
+		for i, segment := range patternSegments {
+			switch {
+			case segment == placeholder:
+				value = pathSegments[i]
+			case strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"):
+				// Other parameters match any segment
+			case segment != pathSegments[i]:
+				return "", false
+			}
+		}
+		return nonEmpty(value)
+	})
+}
+
+// RouteKey uses the method and path of the request, to be combined with other
+// extractors in Composite
+func RouteKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		return r.Method + " " + r.URL.Path, true
+	})
+}
+
+// Composite joins the keys of several extractors, for example the token and the
+// route. The request has no identity unless every extractor finds its key, and
+// the joined key is not an API token
+func Composite(extractors ...KeyExtractor) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		keys := make([]string, 0, len(extractors))
+		for _, extractor := range extractors {
+			key, ok := extractor.Key(r)
+			if !ok {
+				return "", false
+			}
+			keys = append(keys, key)
+		}
+		return strings.Join(keys, ":"), len(keys) > 0
+	})
+}
+
+func nonEmpty(value string) (string, bool) {
+	return value, value != ""
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyExtractors(t *testing.T) {
+	req := httptest.NewRequest("POST", "/tenants/acme/orders/42?user=alice", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s3ss10n"})
+
+	tests := []struct {
+		name      string
+		extractor KeyExtractor
+		expected  string
+		found     bool
+	}{
+		{"Header", HeaderKey("X-Tenant"), "acme", true},
+		{"Missing header", HeaderKey("X-Missing"), "", false},
+		{"Bearer token", BearerToken(), "secret-token", true},
+		{"Query parameter", QueryKey("user"), "alice", true},
+		{"Cookie", CookieKey("session"), "s3ss10n", true},
+		{"Missing cookie", CookieKey("other"), "", false},
+		{"Path parameter", PathParam("/tenants/{tenant}/orders", "tenant"), "acme", true},
+		{"Path parameter after other parameters", PathParam("/tenants/{tenant}/orders/{order}", "order"), "42", true},
+		{"Path not matching the pattern", PathParam("/users/{user}", "user"), "", false},
+		{"Composite", Composite(BearerToken(), RouteKey()), "secret-token:POST /tenants/acme/orders/42", true},
+		{"Composite with a missing key", Composite(BearerToken(), HeaderKey("X-Missing")), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, found := tt.extractor.Key(req)
+			if key != tt.expected || found != tt.found {
+				t.Errorf("Expected key %q and found %v, got %q and %v", tt.expected, tt.found, key, found)
+			}
+		})
+	}
+
+	t.Run("Bearer token requires the Bearer scheme", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+
+		if key, found := BearerToken().Key(req); found {
+			t.Errorf("Expected no key for basic authentication, got %q", key)
+		}
+	})
+}
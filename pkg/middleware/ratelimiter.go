@@ -1,34 +1,100 @@
 package middleware
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 
+	"github.com/alcimerio/gopos-ratelimiter/pkg/access"
 	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
 )
 
 type RateLimiterMiddleware struct {
-	limiter *limiter.RateLimiter
+	limiter      *limiter.RateLimiter
+	headerStyle  HeaderStyle
+	ipResolver   ClientIPResolver
+	keyExtractor KeyExtractor
+	cost         CostFunc
+	rules        *Rules
+	allowlist    access.List
+	denylist     access.List
 }
 
-func NewRateLimiterMiddleware(limiter *limiter.RateLimiter) *RateLimiterMiddleware {
-	return &RateLimiterMiddleware{
-		limiter: limiter,
+// Option configures a RateLimiterMiddleware
+type Option func(*RateLimiterMiddleware)
+
+func NewRateLimiterMiddleware(limiter *limiter.RateLimiter, opts ...Option) *RateLimiterMiddleware {
+	m := &RateLimiterMiddleware{
+		limiter:      limiter,
+		headerStyle:  LegacyHeaders,
+		ipResolver:   &IPResolver{},
+		keyExtractor: HeaderKey("API_KEY"),
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
 func (m *RateLimiterMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Find the rule applying to the request
+		var rule *compiledRule
+		rateLimiter, keyExtractor := m.limiter, m.keyExtractor
+		if m.rules != nil {
+			if rule = m.rules.match(r); rule != nil && !rule.Skip {
+				rateLimiter = rule.limiter
+				if rule.KeyExtractor != nil {
+					keyExtractor = rule.KeyExtractor
+				}
+			}
+		}
+
 		// Get IP address from request
-		ip := r.RemoteAddr
-		if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-			ip = forwardedFor
+		ip := m.ipResolver.ClientIP(r)
+
+		// Get token identifying the request
+		token, _ := keyExtractor.Key(r)
+
+		// Denied requests are rejected and allowed ones bypass the limits, neither
+		// is counted
+		if listed(m.denylist, r, ip, token) {
+			writeError(w, http.StatusForbidden, "access denied")
+			return
+		}
+		if rule != nil && rule.Skip || listed(m.allowlist, r, ip, token) {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		// Get token from header
-		token := r.Header.Get("API_KEY")
+		// Weigh the request
+		cost := 1
+		if m.cost != nil {
+			cost = atLeastOne(m.cost(r))
+		}
 
-		// Check rate limit
-		if err := m.limiter.CheckLimit(r.Context(), ip, token); err != nil {
+		// Check rate limit, only API tokens are checked against the token registry
+		allow := rateLimiter.AllowKeyN
+		if isTokenKey(keyExtractor) {
+			allow = rateLimiter.AllowN
+		}
+		decision, err := allow(r.Context(), ip, token, cost)
+		if errors.Is(err, limiter.ErrUnknownToken) {
+			writeError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		} else if errors.Is(err, limiter.ErrStorageUnavailable) {
+			writeError(w, http.StatusServiceUnavailable, "rate limiter temporarily unavailable")
+			return
+		} else if err != nil {
+			log.Printf("rate limiter failed: %v", err)
+			writeError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		writeRateLimitHeaders(w.Header(), m.headerStyle, decision)
+
+		if !decision.Allowed {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusTooManyRequests)
 			w.Write([]byte(`{"error": "you have reached the maximum number of requests or actions allowed within a certain time frame"}`))
@@ -38,3 +104,9 @@ func (m *RateLimiterMiddleware) Handler(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
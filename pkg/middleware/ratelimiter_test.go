@@ -1,16 +1,30 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/alcimerio/gopos-ratelimiter/pkg/access"
 	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
 	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/tokens"
 )
 
+// failingStorage simulates an unreachable storage
+type failingStorage struct {
+	storage.Storage
+}
+
+func (f failingStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
 func TestRateLimiterMiddleware(t *testing.T) {
 	mockStorage := storage.NewMockStorage()
 	config := limiter.Config{
@@ -126,3 +140,478 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestClientIPKeys(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:       1,
+		TokenLimit:    10,
+		BlockDuration: 5 * time.Minute,
+	}
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("Ephemeral ports share the same limit", func(t *testing.T) {
+		handler := NewRateLimiterMiddleware(limiter.NewRateLimiter(storage.NewMockStorage(), config)).Handler(nextHandler)
+
+		for i, remoteAddr := range []string{"192.168.1.1:5001", "192.168.1.1:5002"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = remoteAddr
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if expected := []int{http.StatusOK, http.StatusTooManyRequests}[i]; rr.Code != expected {
+				t.Errorf("Request %d: expected status code %d, got %d", i+1, expected, rr.Code)
+			}
+		}
+	})
+
+	t.Run("Spoofed X-Forwarded-For does not get a new limit", func(t *testing.T) {
+		handler := NewRateLimiterMiddleware(limiter.NewRateLimiter(storage.NewMockStorage(), config)).Handler(nextHandler)
+
+		for i, forwardedFor := range []string{"1.1.1.1", "2.2.2.2"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.168.1.1:5001"
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if expected := []int{http.StatusOK, http.StatusTooManyRequests}[i]; rr.Code != expected {
+				t.Errorf("Request %d: expected status code %d, got %d", i+1, expected, rr.Code)
+			}
+		}
+	})
+
+	t.Run("Trusted proxies forward the client IP", func(t *testing.T) {
+		resolver, err := NewIPResolver([]string{"10.0.0.0/8"})
+		if err != nil {
+			t.Fatalf("Failed to create resolver: %v", err)
+		}
+		rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+		handler := NewRateLimiterMiddleware(rateLimiter, WithClientIPResolver(resolver)).Handler(nextHandler)
+
+		for i, forwardedFor := range []string{"1.1.1.1", "2.2.2.2"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "10.0.0.1:5001"
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("Request %d: expected status code %d, got %d", i+1, http.StatusOK, rr.Code)
+			}
+		}
+	})
+}
+
+func TestCustomKeyExtractor(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:       1,
+		TokenLimit:    2,
+		BlockDuration: 5 * time.Minute,
+	}
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	handler := NewRateLimiterMiddleware(rateLimiter, WithKeyExtractor(HeaderKey("X-Tenant"))).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}
+	for i, status := range expected {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1"
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("API_KEY", "ignored")
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("Request %d: expected status code %d, got %d", i+1, status, rr.Code)
+		}
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:       10,
+		BlockDuration: 5 * time.Minute,
+	}
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	handler := NewRateLimiterMiddleware(rateLimiter, WithCostFunc(RouteCosts(map[string]int{"/batch": 4}))).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	// 4 + 4 + 1 fit in the limit of 10, another batch would overflow it and is
+	// rejected without being counted or blocking the client. Once the limit is
+	// reached, the next request blocks it
+	requests := []struct {
+		path       string
+		status     int
+		retryAfter string
+	}{
+		{"/batch", http.StatusOK, ""},
+		{"/batch", http.StatusOK, ""},
+		{"/", http.StatusOK, ""},
+		{"/batch", http.StatusTooManyRequests, "1"},
+		{"/", http.StatusOK, ""},
+		{"/", http.StatusTooManyRequests, "300"},
+		{"/", http.StatusTooManyRequests, "300"},
+	}
+	for i, r := range requests {
+		req := httptest.NewRequest("POST", r.path, nil)
+		req.RemoteAddr = "192.168.1.1"
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != r.status {
+			t.Errorf("Request %d: expected status code %d, got %d", i+1, r.status, rr.Code)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); retryAfter != r.retryAfter {
+			t.Errorf("Request %d: expected Retry-After %q, got %q", i+1, r.retryAfter, retryAfter)
+		}
+	}
+
+	// Costs below 1 count as 1 instead of failing the request
+	rateLimiter = limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	handler = NewRateLimiterMiddleware(rateLimiter, WithCostFunc(func(r *http.Request) int { return 0 })).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Remaining") != "9" {
+		t.Errorf("Expected a request costing 0 to count as 1, got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestRouteRules(t *testing.T) {
+	mockStorage := storage.NewMockStorage()
+	config := limiter.Config{
+		IPLimit:       3,
+		BlockDuration: 5 * time.Minute,
+	}
+	rules, err := NewRules(mockStorage, []Rule{
+		{Name: "login", Methods: []string{"POST"}, Path: "/login", Config: limiter.Config{IPLimit: 1, TokenLimit: 1, BlockDuration: time.Minute}},
+		{Name: "health", Path: "/health", Skip: true},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+	rateLimiter := limiter.NewRateLimiter(mockStorage, config)
+	handler := NewRateLimiterMiddleware(rateLimiter, WithRules(rules)).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	serve := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.168.1.1"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve("POST", "/login"); code != http.StatusOK {
+		t.Errorf("Expected first login to be allowed, got %d", code)
+	}
+	if code := serve("POST", "/login"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected second login to be limited by the login rule, got %d", code)
+	}
+
+	// Other routes use the default limits, counted separately from the login rule
+	for i := 0; i < config.IPLimit; i++ {
+		if code := serve("GET", "/orders"); code != http.StatusOK {
+			t.Errorf("Request %d: expected status code %d, got %d", i+1, http.StatusOK, code)
+		}
+	}
+	if code := serve("GET", "/orders"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected default limit to be exceeded, got %d", code)
+	}
+
+	// Skipped routes are never limited
+	for i := 0; i < 10; i++ {
+		if code := serve("GET", "/health"); code != http.StatusOK {
+			t.Errorf("Health check %d: expected status code %d, got %d", i+1, http.StatusOK, code)
+		}
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:       2,
+		TokenLimit:    2,
+		BlockDuration: 5 * time.Minute,
+	}
+	allowlist, err := access.NewMemoryList("ip:10.0.0.0/8", "token:monitoring", "header:X-Internal-Service")
+	if err != nil {
+		t.Fatalf("Failed to create allowlist: %v", err)
+	}
+	denylist, err := access.NewMemoryList("ip:203.0.113.0/24", "token:abuser")
+	if err != nil {
+		t.Fatalf("Failed to create denylist: %v", err)
+	}
+
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+	handler := NewRateLimiterMiddleware(rateLimiter, WithAllowlist(allowlist), WithDenylist(denylist)).Handler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+
+	serve := func(ip string, header http.Header) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("Allowed requests bypass the limits", func(t *testing.T) {
+		requests := []struct {
+			ip     string
+			header http.Header
+		}{
+			{"10.1.2.3", nil},
+			{"192.168.1.1", http.Header{"Api_key": {"monitoring"}}},
+			{"192.168.1.2", http.Header{"X-Internal-Service": {"billing"}}},
+		}
+		for _, r := range requests {
+			for i := 0; i < 5; i++ {
+				if code := serve(r.ip, r.header); code != http.StatusOK {
+					t.Errorf("Request %d from %s: expected status code %d, got %d", i+1, r.ip, http.StatusOK, code)
+				}
+			}
+		}
+	})
+
+	t.Run("Denied requests are rejected", func(t *testing.T) {
+		if code := serve("203.0.113.7", nil); code != http.StatusForbidden {
+			t.Errorf("Expected denied IP to be forbidden, got %d", code)
+		}
+		if code := serve("192.168.1.3", http.Header{"Api_key": {"abuser"}}); code != http.StatusForbidden {
+			t.Errorf("Expected denied token to be forbidden, got %d", code)
+		}
+		if code := serve("10.1.2.3", http.Header{"Api_key": {"abuser"}}); code != http.StatusForbidden {
+			t.Errorf("Expected the denylist to take precedence over the allowlist, got %d", code)
+		}
+	})
+
+	t.Run("Listed requests are not counted", func(t *testing.T) {
+		if err := allowlist.Remove("ip:10.0.0.0/8"); err != nil {
+			t.Fatalf("Failed to remove entry: %v", err)
+		}
+		if err := denylist.Remove("ip:203.0.113.0/24"); err != nil {
+			t.Fatalf("Failed to remove entry: %v", err)
+		}
+
+		for _, ip := range []string{"10.1.2.3", "203.0.113.7"} {
+			for i := 0; i < config.IPLimit; i++ {
+				if code := serve(ip, nil); code != http.StatusOK {
+					t.Errorf("Request %d from %s: expected the full limit to be left, got %d", i+1, ip, code)
+				}
+			}
+			if code := serve(ip, nil); code != http.StatusTooManyRequests {
+				t.Errorf("Expected %s to be limited once unlisted, got %d", ip, code)
+			}
+		}
+	})
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:       2,
+		TokenLimit:    10,
+		BlockDuration: 5 * time.Minute,
+	}
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("Legacy headers on allowed and rejected responses", func(t *testing.T) {
+		mockStorage := storage.NewMockStorage()
+		middleware := NewRateLimiterMiddleware(limiter.NewRateLimiter(mockStorage, config))
+		handler := middleware.Handler(nextHandler)
+
+		expectedRemaining := []string{"1", "0"}
+		for i, remaining := range expectedRemaining {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.168.1.1"
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("Request %d: expected status code %d, got %d", i+1, http.StatusOK, rr.Code)
+			}
+			if limit := rr.Header().Get("X-RateLimit-Limit"); limit != "2" {
+				t.Errorf("Request %d: expected X-RateLimit-Limit 2, got %q", i+1, limit)
+			}
+			if got := rr.Header().Get("X-RateLimit-Remaining"); got != remaining {
+				t.Errorf("Request %d: expected X-RateLimit-Remaining %s, got %q", i+1, remaining, got)
+			}
+			if reset := rr.Header().Get("X-RateLimit-Reset"); reset == "" {
+				t.Errorf("Request %d: expected X-RateLimit-Reset header", i+1)
+			}
+			if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "" {
+				t.Errorf("Request %d: expected no Retry-After on allowed response, got %q", i+1, retryAfter)
+			}
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1"
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "300" {
+			t.Errorf("Expected Retry-After 300, got %q", retryAfter)
+		}
+
+		// Remaining block time is reported on later requests
+		mockStorage.AdvanceTime(time.Minute)
+		rr = httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "240" {
+			t.Errorf("Expected Retry-After 240, got %q", retryAfter)
+		}
+		if remaining := rr.Header().Get("X-RateLimit-Remaining"); remaining != "0" {
+			t.Errorf("Expected X-RateLimit-Remaining 0, got %q", remaining)
+		}
+	})
+
+	t.Run("IETF headers", func(t *testing.T) {
+		rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config)
+		handler := NewRateLimiterMiddleware(rateLimiter, WithHeaderStyle(IETFHeaders)).Handler(nextHandler)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.1"
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if policy := rr.Header().Get("RateLimit-Policy"); policy != `"ip";q=2;w=1` {
+			t.Errorf(`Expected RateLimit-Policy "ip";q=2;w=1, got %q`, policy)
+		}
+		if limit := rr.Header().Get("RateLimit"); limit != `"ip";r=1;t=1` {
+			t.Errorf(`Expected RateLimit "ip";r=1;t=1, got %q`, limit)
+		}
+		if legacy := rr.Header().Get("X-RateLimit-Limit"); legacy != "" {
+			t.Errorf("Expected no legacy headers, got X-RateLimit-Limit %q", legacy)
+		}
+	})
+}
+
+func TestStorageFailures(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:       5,
+		TokenLimit:    10,
+		BlockDuration: 5 * time.Minute,
+	}
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("Fail closed answers service unavailable", func(t *testing.T) {
+		rateLimiter := limiter.NewRateLimiter(failingStorage{storage.NewMockStorage()}, config)
+		handler := NewRateLimiterMiddleware(rateLimiter).Handler(nextHandler)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+	})
+
+	t.Run("Fail open lets requests through", func(t *testing.T) {
+		config := config
+		config.FailurePolicy = limiter.FailOpen
+		rateLimiter := limiter.NewRateLimiter(failingStorage{storage.NewMockStorage()}, config)
+		handler := NewRateLimiterMiddleware(rateLimiter).Handler(nextHandler)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		// The reset is the end of a window from now, not the zero time
+		reset, err := strconv.ParseInt(rr.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if now := time.Now().Unix(); err != nil || reset < now || reset > now+1 {
+			t.Errorf("Expected X-RateLimit-Reset to be within a second, got %q", rr.Header().Get("X-RateLimit-Reset"))
+		}
+	})
+}
+
+func TestUnknownTokens(t *testing.T) {
+	config := limiter.Config{
+		IPLimit:            5,
+		TokenLimit:         10,
+		BlockDuration:      5 * time.Minute,
+		UnknownTokenPolicy: limiter.RejectUnknownTokens,
+	}
+	rateLimiter := limiter.NewRateLimiter(storage.NewMockStorage(), config, limiter.WithTokenRegistry(tokens.NewMemoryRegistry("abc123")))
+	handler := NewRateLimiterMiddleware(rateLimiter).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("API_KEY", "not-registered")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	req.Header.Set("API_KEY", "abc123")
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// Sessions are not tokens, the registry does not apply to them
+	handler = NewRateLimiterMiddleware(rateLimiter, WithKeyExtractor(CookieKey("session"))).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s3ss10n"})
+	rr = httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "10" {
+		t.Errorf("Expected the session to get the token limit, got %d %v", rr.Code, rr.Header())
+	}
+}
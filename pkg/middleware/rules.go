@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+// PathMatch selects how the path of a Rule is matched
+type PathMatch string
+
+const (
+	// PrefixMatch matches paths starting with the rule path
+	PrefixMatch PathMatch = "prefix"
+
+	// GlobMatch matches paths with path.Match, where "*" does not cross slashes
+	GlobMatch PathMatch = "glob"
+
+	// RegexMatch matches paths containing a match of the regular expression,
+	// anchor it with ^ and $ to match whole paths
+	RegexMatch PathMatch = "regex"
+)
+
+// Rule limits the requests matching its method, host and path with its own
+// limits, algorithm and key extractor. Empty fields match every request
+type Rule struct {
+	// Name identifies the rule and namespaces its storage keys
+	Name string
+
+	// Methods are the HTTP methods matched
+	Methods []string
+
+	// Host is the host matched, ignoring the port. It may be a glob such as
+	// "*.example.com"
+	Host string
+
+	// Path is the path pattern matched, interpreted according to PathMatch
+	Path string
+
+	// PathMatch defaults to PrefixMatch
+	PathMatch PathMatch
+
+	// Config holds the limits and algorithm of the rule. Its Namespace defaults
+	// to the rule name
+	Config limiter.Config
+
+	// KeyExtractor defaults to the key extractor of the middleware
+	KeyExtractor KeyExtractor
+
+	// Skip leaves the matched requests unlimited, such as health checks
+	Skip bool
+}
+
+// Rules is an ordered rule table, the first rule matching a request applies.
+// Requests matching no rule fall through to the limiter of the middleware, add a
+// last rule with Skip and no conditions to leave them unlimited instead
+type Rules struct {
+	rules []*compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	limiter *limiter.RateLimiter
+	path    *regexp.Regexp
+}
+
+// NewRules validates the rules and creates a limiter for each of them on the
+// given storage. Options, such as the token registry, apply to every rule
+func NewRules(s storage.Storage, rules []Rule, opts ...limiter.Option) (*Rules, error) {
+	table := &Rules{}
+	names := make(map[string]bool)
+
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid rate limit rule %q:\n%w", rule.Name, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rate limit rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		compiled := &compiledRule{Rule: rule}
+		if rule.PathMatch == RegexMatch {
+			compiled.path = regexp.MustCompile(rule.Path)
+		}
+
+		if !rule.Skip {
+			config := rule.Config
+			if config.Namespace == "" {
+				config.Namespace = rule.Name
+			}
+			compiled.limiter = limiter.NewRateLimiter(s, config, opts...)
+		}
+
+		table.rules = append(table.rules, compiled)
+	}
+
+	return table, nil
+}
+
+// Validate reports every problem of the rule at once, including the errors of
+// its Config unless it is a Skip rule
+func (r Rule) Validate() error {
+	var errs []error
+
+	if r.Name == "" {
+		errs = append(errs, fmt.Errorf("rate limit rules must have a name"))
+	}
+	if _, err := path.Match(r.Host, ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid host: %v", err))
+	}
+
+	switch r.PathMatch {
+	case "", PrefixMatch:
+	case GlobMatch:
+		if _, err := path.Match(r.Path, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid path: %v", err))
+		}
+	case RegexMatch:
+		if _, err := regexp.Compile(r.Path); err != nil {
+			errs = append(errs, fmt.Errorf("invalid path: %v", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupported path match %q, use %q, %q or %q", r.PathMatch, PrefixMatch, GlobMatch, RegexMatch))
+	}
+
+	if !r.Skip {
+		if err := r.Config.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// WithRules applies a rule table before the limiter of the middleware
+func WithRules(rules *Rules) Option {
+	return func(m *RateLimiterMiddleware) {
+		m.rules = rules
+	}
+}
+
+// match returns the first rule matching the request, or nil
+func (t *Rules) match(r *http.Request) *compiledRule {
+	for _, rule := range t.rules {
+		if rule.matches(r) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (rule *compiledRule) matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, r.Method) {
+		return false
+	}
+
+	if rule.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if matched, _ := path.Match(strings.ToLower(rule.Host), strings.ToLower(host)); !matched {
+			return false
+		}
+	}
+
+	switch rule.PathMatch {
+	case GlobMatch:
+		matched, _ := path.Match(rule.Path, r.URL.Path)
+		return matched
+	case RegexMatch:
+		return rule.path.MatchString(r.URL.Path)
+	default:
+		return strings.HasPrefix(r.URL.Path, rule.Path)
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
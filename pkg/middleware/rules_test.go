@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alcimerio/gopos-ratelimiter/pkg/limiter"
+	"github.com/alcimerio/gopos-ratelimiter/pkg/storage"
+)
+
+func TestRulesMatch(t *testing.T) {
+	config := limiter.Config{IPLimit: 10, TokenLimit: 100, BlockDuration: time.Minute}
+	rules, err := NewRules(storage.NewMockStorage(), []Rule{
+		{Name: "login", Methods: []string{"POST"}, Path: "/login", Config: config},
+		{Name: "health", Path: "/health", Skip: true},
+		{Name: "reports", Path: "/reports/*/pdf", PathMatch: GlobMatch, Config: config},
+		{Name: "orders", Path: `^/orders/[0-9]+$`, PathMatch: RegexMatch, Config: config},
+		{Name: "admin", Host: "admin.*", Path: "/", Config: config},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create rules: %v", err)
+	}
+
+	tests := []struct {
+		method   string
+		target   string
+		expected string
+	}{
+		{"POST", "/login", "login"},
+		{"GET", "/login", ""},
+		{"GET", "/health/ready", "health"},
+		{"GET", "/reports/2024/pdf", "reports"},
+		{"GET", "/reports/2024/01/pdf", ""},
+		{"GET", "/orders/42", "orders"},
+		{"GET", "/orders/42/items", ""},
+		{"GET", "http://admin.example.com:8080/users", "admin"},
+		{"GET", "http://www.example.com/users", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			var name string
+			if rule := rules.match(httptest.NewRequest(tt.method, tt.target, nil)); rule != nil {
+				name = rule.Name
+			}
+			if name != tt.expected {
+				t.Errorf("Expected rule %q, got %q", tt.expected, name)
+			}
+		})
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+	}{
+		{"Missing name", []Rule{{Path: "/", Skip: true}}},
+		{"Duplicate name", []Rule{{Name: "a", Skip: true}, {Name: "a", Skip: true}}},
+		{"Invalid glob", []Rule{{Name: "a", Path: "/[", PathMatch: GlobMatch, Skip: true}}},
+		{"Invalid regex", []Rule{{Name: "a", Path: "(", PathMatch: RegexMatch, Skip: true}}},
+		{"Unknown path match", []Rule{{Name: "a", PathMatch: "exact", Skip: true}}},
+		{"Invalid limits", []Rule{{Name: "a", Config: limiter.Config{IPLimit: -1, TokenLimit: 10, BlockDuration: time.Minute}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRules(storage.NewMockStorage(), tt.rules); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
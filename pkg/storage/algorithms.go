@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// bucket is the in-memory state of a token bucket
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func takeToken(b *bucket, now time.Time, capacity int64, rate float64, cost int64) Result {
+	if b.updated.IsZero() {
+		b.tokens = float64(capacity)
+		b.updated = now
+	}
+
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(capacity), b.tokens+elapsed.Seconds()*rate)
+		b.updated = now
+	}
+
+	result := Result{}
+	if b.tokens >= float64(cost) {
+		b.tokens -= float64(cost)
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((float64(cost) - b.tokens) / rate)
+	}
+
+	result.Remaining = int64(b.tokens)
+	result.ResetAfter = secondsToDuration((float64(capacity) - b.tokens) / rate)
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+// windowLog is the in-memory state of a sliding window log
+type windowLog struct {
+	entries []time.Time
+}
+
+func slidingWindowLog(l *windowLog, now time.Time, limit int64, window time.Duration, cost int64) Result {
+	// Drop the requests that left the window
+	start := now.Add(-window)
+	i := 0
+	for i < len(l.entries) && !l.entries[i].After(start) {
+		i++
+	}
+	l.entries = l.entries[i:]
+
+	result := Result{}
+	if count := int64(len(l.entries)); count+cost <= limit {
+		for i := int64(0); i < cost; i++ {
+			l.entries = append(l.entries, now)
+		}
+		result.Allowed = true
+	} else if leaving := count + cost - limit; leaving <= count {
+		// Wait until enough requests leave the window for the cost to fit
+		result.RetryAfter = l.entries[leaving-1].Add(window).Sub(now)
+	}
+
+	result.Remaining = limit - int64(len(l.entries))
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	if len(l.entries) > 0 {
+		result.ResetAfter = l.entries[len(l.entries)-1].Add(window).Sub(now)
+	}
+	return result
+}
+
+// windowCounter is the in-memory state of a sliding window counter
+type windowCounter struct {
+	window   int64
+	current  int64
+	previous int64
+}
+
+func slidingWindowCounter(c *windowCounter, now time.Time, limit int64, window time.Duration, cost int64) Result {
+	index := now.UnixNano() / int64(window)
+	switch index {
+	case c.window:
+	case c.window + 1:
+		c.previous, c.current = c.current, 0
+	default:
+		c.previous, c.current = 0, 0
+	}
+	c.window = index
+
+	elapsed := time.Duration(now.UnixNano() - index*int64(window))
+	weight := 1 - float64(elapsed)/float64(window)
+	estimated := float64(c.previous)*weight + float64(c.current)
+
+	result := Result{}
+	if estimated+float64(cost) <= float64(limit) {
+		c.current += cost
+		estimated += float64(cost)
+		result.Allowed = true
+	} else if c.current+cost <= limit && c.previous > 0 {
+		// Wait until the previous window weighs little enough for the cost to fit
+		wait := 1 - float64(limit-c.current-cost)/float64(c.previous)
+		result.RetryAfter = time.Duration(wait*float64(window)) - elapsed
+	} else {
+		result.RetryAfter = window - elapsed
+	}
+
+	result.Remaining = int64(float64(limit) - estimated)
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	if c.current > 0 {
+		result.ResetAfter = 2*window - elapsed
+	} else if c.previous > 0 {
+		result.ResetAfter = window - elapsed
+	}
+	return result
+}
+
+// gcra evaluates the generic cell rate algorithm over the theoretical arrival time of a key
+func gcra(tat *time.Time, now time.Time, burst int64, interval time.Duration, cost int64) Result {
+	arrival := *tat
+	if arrival.Before(now) {
+		arrival = now
+	}
+
+	tolerance := time.Duration(burst) * interval
+	next := arrival.Add(time.Duration(cost) * interval)
+	if allowAt := next.Add(-tolerance); now.Before(allowAt) {
+		return Result{
+			Remaining:  int64((tolerance - arrival.Sub(now)) / interval),
+			RetryAfter: allowAt.Sub(now),
+			ResetAfter: arrival.Sub(now),
+		}
+	}
+
+	*tat = next
+	return Result{
+		Allowed:    true,
+		Remaining:  int64((tolerance - next.Sub(now)) / interval),
+		ResetAfter: next.Sub(now),
+	}
+}
+
+// fixedWindow is the in-memory state of a counter in a fixed window
+type fixedWindow struct {
+	count   int64
+	expires time.Time
+}
+
+func (w *fixedWindow) add(amount int64) int64 {
+	w.count += amount
+	return w.count
+}
+
+func incrementWindows(counters []*fixedWindow, now time.Time, windows []Window, cost int64) ([]WindowCount, int) {
+	exceeded := -1
+	for i, counter := range counters {
+		if !counter.expires.After(now) {
+			counter.count = 0
+			counter.expires = now.Add(windows[i].Period)
+		}
+		if exceeded == -1 && counter.count+cost > windows[i].Limit {
+			exceeded = i
+		}
+	}
+
+	counts := make([]WindowCount, len(counters))
+	for i, counter := range counters {
+		if exceeded == -1 {
+			counter.count += cost
+		}
+		counts[i] = WindowCount{Count: counter.count, ResetAfter: counter.expires.Sub(now)}
+	}
+	return counts, exceeded
+}
+
+// For returns how long to block a key on its nth violation
+func (b BlockPolicy) For(violations int64) time.Duration {
+	if b.Multiplier <= 0 || violations <= 1 {
+		return b.Duration
+	}
+
+	duration := float64(b.Duration) * math.Pow(b.Multiplier, float64(violations-1))
+	if b.MaxDuration > 0 && duration > float64(b.MaxDuration) {
+		return b.MaxDuration
+	}
+	if duration > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(duration)
+}
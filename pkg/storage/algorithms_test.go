@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCRA(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	interval := 100 * time.Millisecond
+	var tat time.Time
+
+	t.Run("Reports remaining requests of the burst", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			result := gcra(&tat, now, 3, interval, 1)
+			if !result.Allowed {
+				t.Fatalf("Expected request %d to be allowed", i+1)
+			}
+			if result.Remaining != int64(2-i) {
+				t.Errorf("Expected %d remaining requests, got %d", 2-i, result.Remaining)
+			}
+			if expected := time.Duration(i+1) * interval; result.ResetAfter != expected {
+				t.Errorf("Expected reset after %v, got %v", expected, result.ResetAfter)
+			}
+		}
+	})
+
+	t.Run("Reports exact retry after when rejected", func(t *testing.T) {
+		now = now.Add(30 * time.Millisecond)
+
+		result := gcra(&tat, now, 3, interval, 1)
+		if result.Allowed {
+			t.Fatal("Expected request to be rejected")
+		}
+		if result.Remaining != 0 {
+			t.Errorf("Expected no remaining requests, got %d", result.Remaining)
+		}
+		if result.RetryAfter != 70*time.Millisecond {
+			t.Errorf("Expected retry after 70ms, got %v", result.RetryAfter)
+		}
+
+		result = gcra(&tat, now.Add(result.RetryAfter), 3, interval, 1)
+		if !result.Allowed {
+			t.Error("Expected request to be allowed after the retry after")
+		}
+	})
+
+	t.Run("Recovers the full burst after idling", func(t *testing.T) {
+		now = now.Add(time.Second)
+
+		result := gcra(&tat, now, 3, interval, 1)
+		if !result.Allowed || result.Remaining != 2 {
+			t.Errorf("Expected allowed request with 2 remaining, got %+v", result)
+		}
+	})
+
+	t.Run("Requests costing several intervals", func(t *testing.T) {
+		now = now.Add(time.Second)
+
+		result := gcra(&tat, now, 3, interval, 2)
+		if !result.Allowed || result.Remaining != 1 {
+			t.Errorf("Expected request costing 2 to be allowed with 1 remaining, got %+v", result)
+		}
+
+		result = gcra(&tat, now, 3, interval, 2)
+		if result.Allowed || result.RetryAfter != interval {
+			t.Errorf("Expected request costing 2 to be rejected for one interval, got %+v", result)
+		}
+	})
+}
@@ -0,0 +1,557 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoryMaxKeys         = 100000
+	defaultMemoryShards          = 32
+	defaultMemoryCleanupInterval = time.Minute
+)
+
+// MemoryStorage keeps the state of the rate limiter in the memory of the process,
+// for single instance services and as the fallback storage of the FailLocal
+// policy. Keys expire like their Redis counterparts, expired keys are removed in
+// the background, and the least recently used keys are evicted once the storage
+// holds MaxKeys keys. Blocks are never evicted, so a client cannot lift its own
+// block by flooding the storage with new keys. Keys are spread over shards with
+// their own lock, and every key derived from a rate limiter key, such as its
+// block, is kept in the same shard so the algorithms are atomic
+type MemoryStorage struct {
+	shards          []*memoryShard
+	maxKeys         int
+	cleanupInterval time.Duration
+	now             func() time.Time
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// MemoryOption configures a MemoryStorage
+type MemoryOption func(*MemoryStorage)
+
+// WithMaxKeys caps the number of keys of the storage, split evenly between its
+// shards, defaults to 100000. Zero removes the cap. Blocks are not evicted, so
+// they are not counted in the cap
+func WithMaxKeys(maxKeys int) MemoryOption {
+	return func(m *MemoryStorage) {
+		m.maxKeys = maxKeys
+	}
+}
+
+// WithShards sets the number of shards of the storage, each with its own lock,
+// defaults to 32
+func WithShards(shards int) MemoryOption {
+	return func(m *MemoryStorage) {
+		if shards > 0 {
+			m.shards = make([]*memoryShard, shards)
+		}
+	}
+}
+
+// WithCleanupInterval sets how often expired keys are removed in the background,
+// defaults to one minute. Zero disables the background cleanup, expired keys are
+// then only removed when they are read or evicted
+func WithCleanupInterval(interval time.Duration) MemoryOption {
+	return func(m *MemoryStorage) {
+		m.cleanupInterval = interval
+	}
+}
+
+// NewMemoryStorage creates an in-memory storage and starts its background cleanup.
+// Close stops it
+func NewMemoryStorage(opts ...MemoryOption) *MemoryStorage {
+	m := &MemoryStorage{
+		shards:          make([]*memoryShard, defaultMemoryShards),
+		maxKeys:         defaultMemoryMaxKeys,
+		cleanupInterval: defaultMemoryCleanupInterval,
+		now:             time.Now,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	shardKeys := 0
+	if m.maxKeys > 0 {
+		shardKeys = (m.maxKeys + len(m.shards) - 1) / len(m.shards)
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{
+			entries: make(map[string]*list.Element),
+			lru:     list.New(),
+			blocks:  make(map[string]time.Time),
+			maxKeys: shardKeys,
+		}
+	}
+
+	if m.cleanupInterval > 0 {
+		go m.cleanup()
+	} else {
+		close(m.done)
+	}
+	return m
+}
+
+// cleanup removes the expired keys of every shard each cleanup interval, until
+// the storage is closed
+func (m *MemoryStorage) cleanup() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.RemoveExpired()
+		}
+	}
+}
+
+// RemoveExpired removes every expired key at once and returns how many were
+// removed. It is called in the background every cleanup interval
+func (m *MemoryStorage) RemoveExpired() int {
+	now := m.now()
+	removed := 0
+	for _, s := range m.shards {
+		s.mutex.Lock()
+		removed += s.removeExpired(now)
+		s.mutex.Unlock()
+	}
+	return removed
+}
+
+// Len returns the number of keys of the storage, blocks included, including the
+// expired keys not removed yet
+func (m *MemoryStorage) Len() int {
+	length := 0
+	for _, s := range m.shards {
+		s.mutex.Lock()
+		length += s.lru.Len() + len(s.blocks)
+		s.mutex.Unlock()
+	}
+	return length
+}
+
+// shard returns the shard of a rate limiter key, hashed with 32 bit FNV-1a
+func (m *MemoryStorage) shard(key string) *memoryShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return m.shards[hash%uint32(len(m.shards))]
+}
+
+func (m *MemoryStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return m.IncrementBy(ctx, key, 1, expiration)
+}
+
+func (m *MemoryStorage) IncrementBy(ctx context.Context, key string, amount int64, expiration time.Duration) (int64, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.counter(key, expiration, m.now()).add(amount), nil
+}
+
+func (m *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, blocked := s.blockedFor(key, 0, m.now())
+	return blocked, nil
+}
+
+func (m *MemoryStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	remaining, _ := s.blockedFor(key, -1, m.now())
+	return remaining, nil
+}
+
+// Block blocks a key for duration, without expiration when duration is not
+// positive, like a Redis key set without TTL
+func (m *MemoryStorage) Block(ctx context.Context, key string, duration time.Duration) error {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.blocks[key] = expiresAt(m.now(), duration)
+	return nil
+}
+
+func (m *MemoryStorage) Reset(ctx context.Context, key string) error {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Delete the counter key, the blocked key and the algorithm states
+	s.delete(key)
+	delete(s.blocks, key)
+	s.delete("bucket:" + key)
+	s.delete("log:" + key)
+	s.delete("window:" + key)
+	s.delete("gcra:" + key)
+	return nil
+}
+
+func (m *MemoryStorage) TakeToken(ctx context.Context, key string, capacity int64, rate float64, cost int64) (Result, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	bucketKey := "bucket:" + key
+	b, exists := s.get(bucketKey, now).(*bucket)
+	if !exists {
+		b = &bucket{}
+	}
+
+	result := takeToken(b, now, capacity, rate, cost)
+	s.setFor(bucketKey, b, result.ResetAfter, now)
+	return result, nil
+}
+
+func (m *MemoryStorage) SlidingWindowLog(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	logKey := "log:" + key
+	l, exists := s.get(logKey, now).(*windowLog)
+	if !exists {
+		l = &windowLog{}
+	}
+
+	result := slidingWindowLog(l, now, limit, window, cost)
+	s.setFor(logKey, l, result.ResetAfter, now)
+	return result, nil
+}
+
+func (m *MemoryStorage) SlidingWindowCounter(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	windowKey := "window:" + key
+	c, exists := s.get(windowKey, now).(*windowCounter)
+	if !exists {
+		c = &windowCounter{}
+	}
+
+	result := slidingWindowCounter(c, now, limit, window, cost)
+	s.setFor(windowKey, c, result.ResetAfter, now)
+	return result, nil
+}
+
+func (m *MemoryStorage) GCRA(ctx context.Context, key string, burst int64, interval time.Duration, cost int64) (Result, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	gcraKey := "gcra:" + key
+	tat, _ := s.get(gcraKey, now).(time.Time)
+
+	result := gcra(&tat, now, burst, interval, cost)
+	s.setFor(gcraKey, tat, tat.Sub(now), now)
+	return result, nil
+}
+
+// IncrementWindows keeps one counter per window, named after the key and the
+// window period. Reset does not clear them, they expire with their window
+func (m *MemoryStorage) IncrementWindows(ctx context.Context, key string, windows []Window, cost int64, block BlockPolicy) (WindowsResult, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	if remaining, blocked := s.blockedFor(key, block.Duration, now); blocked {
+		return WindowsResult{Blocked: remaining}, nil
+	}
+
+	keys := make([]string, len(windows))
+	counters := make([]*fixedWindow, len(windows))
+	for i, window := range windows {
+		keys[i] = fmt.Sprintf("windows:%d:%s", window.Period.Milliseconds(), key)
+		counter, exists := s.get(keys[i], now).(*fixedWindow)
+		if !exists {
+			counter = &fixedWindow{}
+		}
+		counters[i] = counter
+	}
+
+	counts, exceeded := incrementWindows(counters, now, windows, cost)
+	for i, counter := range counters {
+		s.set(keys[i], counter, counter.expires)
+	}
+
+	result := WindowsResult{Counts: counts, Exceeded: exceeded}
+	if exceeded == 0 && counts[0].Count >= windows[0].Limit {
+		result.Blocked = s.block(key, block, now)
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) ConsumeQuota(ctx context.Context, key string, amount, limit int64, expiresAt time.Time) (int64, bool, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	usage, exists := s.get(key, now).(*fixedWindow)
+	if !exists {
+		usage = &fixedWindow{}
+	}
+
+	if amount > 0 && usage.count+amount > limit {
+		return usage.count, false, nil
+	}
+
+	usage.add(amount)
+	usage.expires = expiresAt
+	s.set(key, usage, expiresAt)
+	return usage.count, true, nil
+}
+
+func (m *MemoryStorage) QuotaUsage(ctx context.Context, key string) (int64, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if usage, exists := s.get(key, m.now()).(*fixedWindow); exists {
+		return usage.count, nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryStorage) FixedWindow(ctx context.Context, key string, limit int64, window time.Duration, cost int64, block BlockPolicy) (Result, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := m.now()
+	if remaining, blocked := s.blockedFor(key, block.Duration, now); blocked {
+		return Result{RetryAfter: remaining, ResetAfter: remaining}, nil
+	}
+
+	counter := s.counter(key, window, now)
+	if counter.count+cost <= limit {
+		counter.add(cost)
+		return Result{
+			Allowed:    true,
+			Remaining:  limit - counter.count,
+			ResetAfter: counter.expires.Sub(now),
+		}, nil
+	}
+
+	// A request whose cost does not fit is rejected without being counted, the key
+	// is only blocked once it has used its whole limit
+	if counter.count < limit {
+		reset := counter.expires.Sub(now)
+		return Result{Remaining: limit - counter.count, RetryAfter: reset, ResetAfter: reset}, nil
+	}
+
+	s.delete(key)
+	duration := s.block(key, block, now)
+	return Result{RetryAfter: duration, ResetAfter: duration}, nil
+}
+
+func (m *MemoryStorage) AddViolation(ctx context.Context, key string, decay time.Duration) (int64, error) {
+	s := m.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.addViolation(key, decay, m.now()), nil
+}
+
+// Close stops the background cleanup and waits for it to return. The keys are
+// kept, the storage can still be used
+func (m *MemoryStorage) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	<-m.done
+	return nil
+}
+
+// memoryShard holds a part of the keys of a MemoryStorage in a map, and in a list
+// ordered from the most to the least recently used for eviction. Blocks are kept
+// apart, with their expiration, and only removed once they expire. Its methods
+// must be called with the mutex held
+type memoryShard struct {
+	entries map[string]*list.Element
+	lru     *list.List
+	blocks  map[string]time.Time
+	maxKeys int
+	mutex   sync.Mutex
+}
+
+// memoryEntry is a key of a MemoryStorage. Keys with a zero expiration never expire
+type memoryEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !e.expires.After(now)
+}
+
+// entry returns the entry of a key and marks it as recently used, nil when the
+// key does not exist or expired
+func (s *memoryShard) entry(key string, now time.Time) *memoryEntry {
+	element, exists := s.entries[key]
+	if !exists {
+		return nil
+	}
+
+	e := element.Value.(*memoryEntry)
+	if e.expired(now) {
+		s.remove(element)
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	return e
+}
+
+// get returns the value of a key, nil when the key does not exist or expired
+func (s *memoryShard) get(key string, now time.Time) interface{} {
+	if e := s.entry(key, now); e != nil {
+		return e.value
+	}
+	return nil
+}
+
+// set stores the value of a key until expires, evicting the least recently used
+// key when the shard is full
+func (s *memoryShard) set(key string, value interface{}, expires time.Time) {
+	if element, exists := s.entries[key]; exists {
+		e := element.Value.(*memoryEntry)
+		e.value = value
+		e.expires = expires
+		s.lru.MoveToFront(element)
+		return
+	}
+
+	if s.maxKeys > 0 && s.lru.Len() >= s.maxKeys {
+		s.remove(s.lru.Back())
+	}
+	s.entries[key] = s.lru.PushFront(&memoryEntry{key: key, value: value, expires: expires})
+}
+
+// setFor stores the value of a key for ttl, or deletes the key when ttl is not
+// positive because its value is back to the initial state
+func (s *memoryShard) setFor(key string, value interface{}, ttl time.Duration, now time.Time) {
+	if ttl <= 0 {
+		s.delete(key)
+		return
+	}
+	s.set(key, value, now.Add(ttl))
+}
+
+func (s *memoryShard) delete(key string) {
+	if element, exists := s.entries[key]; exists {
+		s.remove(element)
+	}
+}
+
+func (s *memoryShard) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.entries, element.Value.(*memoryEntry).key)
+}
+
+func (s *memoryShard) removeExpired(now time.Time) int {
+	removed := 0
+	for _, element := range s.entries {
+		if element.Value.(*memoryEntry).expired(now) {
+			s.remove(element)
+			removed++
+		}
+	}
+	for key, expires := range s.blocks {
+		if !expires.IsZero() && !expires.After(now) {
+			delete(s.blocks, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// counter returns the counter of a key, starting a new window with the given
+// expiration when it has none or it expired
+func (s *memoryShard) counter(key string, expiration time.Duration, now time.Time) *fixedWindow {
+	counter, exists := s.get(key, now).(*fixedWindow)
+	if !exists {
+		counter = &fixedWindow{expires: expiresAt(now, expiration)}
+		s.set(key, counter, counter.expires)
+	}
+	return counter
+}
+
+// addViolation records a violation in the history of a key, kept for decay
+func (s *memoryShard) addViolation(key string, decay time.Duration, now time.Time) int64 {
+	violationsKey := "violations:" + key
+	history, exists := s.get(violationsKey, now).(*fixedWindow)
+	if !exists {
+		history = &fixedWindow{}
+	}
+
+	history.count++
+	history.expires = expiresAt(now, decay)
+	s.set(violationsKey, history, history.expires)
+	return history.count
+}
+
+// blockedFor returns the remaining block of a key and whether it is blocked,
+// duration when it is blocked without expiration
+func (s *memoryShard) blockedFor(key string, duration time.Duration, now time.Time) (time.Duration, bool) {
+	expires, exists := s.blocks[key]
+	switch {
+	case !exists:
+		return 0, false
+	case expires.IsZero():
+		return duration, true
+	case !expires.After(now):
+		delete(s.blocks, key)
+		return 0, false
+	}
+	return expires.Sub(now), true
+}
+
+// block blocks a key according to the block policy and returns for how long,
+// recording a violation when penalties are enabled
+func (s *memoryShard) block(key string, block BlockPolicy, now time.Time) time.Duration {
+	violations := int64(1)
+	if block.Multiplier > 0 {
+		violations = s.addViolation(key, block.Decay, now)
+	}
+
+	duration := block.For(violations)
+	s.blocks[key] = now.Add(duration)
+	return duration
+}
+
+// expiresAt returns when a key set for ttl expires, never when ttl is not positive
+func expiresAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupTestMemory returns a memory storage without background cleanup and a
+// function that moves its clock forward
+func setupTestMemory(t *testing.T, opts ...MemoryOption) (*MemoryStorage, func(time.Duration)) {
+	storage := NewMemoryStorage(append([]MemoryOption{WithCleanupInterval(0)}, opts...)...)
+	t.Cleanup(func() { storage.Close() })
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mutex sync.Mutex
+	storage.now = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	return storage, func(d time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now = now.Add(d)
+	}
+}
+
+func TestMemoryStorage_Expiration(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Counters expire with their window", func(t *testing.T) {
+		storage, advance := setupTestMemory(t)
+
+		for i := int64(1); i <= 3; i++ {
+			count, err := storage.Increment(ctx, "counter", time.Second)
+			if err != nil {
+				t.Fatalf("Failed to increment: %v", err)
+			}
+			if count != i {
+				t.Errorf("Expected count %d, got %d", i, count)
+			}
+			advance(300 * time.Millisecond)
+		}
+
+		// The window started with the first increment
+		advance(100 * time.Millisecond)
+		if count, _ := storage.Increment(ctx, "counter", time.Second); count != 1 {
+			t.Errorf("Expected a new window, got count %d", count)
+		}
+	})
+
+	t.Run("Blocks expire", func(t *testing.T) {
+		storage, advance := setupTestMemory(t)
+
+		storage.Block(ctx, "blocked", time.Minute)
+		if ttl, _ := storage.BlockTTL(ctx, "blocked"); ttl != time.Minute {
+			t.Errorf("Expected a block of a minute, got %v", ttl)
+		}
+
+		advance(time.Minute)
+		if blocked, _ := storage.IsBlocked(ctx, "blocked"); blocked {
+			t.Error("Expected the block to expire")
+		}
+		if ttl, _ := storage.BlockTTL(ctx, "blocked"); ttl != 0 {
+			t.Errorf("Expected no block, got %v", ttl)
+		}
+
+		storage.Block(ctx, "forever", 0)
+		advance(24 * time.Hour)
+		if ttl, _ := storage.BlockTTL(ctx, "forever"); ttl >= 0 {
+			t.Errorf("Expected a block without expiration, got %v", ttl)
+		}
+	})
+
+	t.Run("Reset keeps the violations", func(t *testing.T) {
+		storage, _ := setupTestMemory(t)
+
+		storage.Increment(ctx, "reset", time.Minute)
+		storage.Block(ctx, "reset", time.Minute)
+		storage.TakeToken(ctx, "reset", 10, 1, 1)
+		storage.AddViolation(ctx, "reset", time.Hour)
+
+		if err := storage.Reset(ctx, "reset"); err != nil {
+			t.Fatalf("Failed to reset: %v", err)
+		}
+		if blocked, _ := storage.IsBlocked(ctx, "reset"); blocked {
+			t.Error("Expected the block to be reset")
+		}
+		if count, _ := storage.Increment(ctx, "reset", time.Minute); count != 1 {
+			t.Errorf("Expected the counter to be reset, got %d", count)
+		}
+		if result, _ := storage.TakeToken(ctx, "reset", 10, 1, 1); result.Remaining != 9 {
+			t.Errorf("Expected a full bucket, got %d remaining", result.Remaining)
+		}
+		if violations, _ := storage.AddViolation(ctx, "reset", time.Hour); violations != 2 {
+			t.Errorf("Expected the violations to be kept, got %d", violations)
+		}
+	})
+
+	t.Run("Algorithm states expire once back to their initial state", func(t *testing.T) {
+		storage, advance := setupTestMemory(t)
+
+		storage.TakeToken(ctx, "bucket", 10, 10, 5)
+		storage.SlidingWindowLog(ctx, "log", 10, time.Second, 1)
+		storage.SlidingWindowCounter(ctx, "window", 10, time.Second, 1)
+		storage.GCRA(ctx, "gcra", 10, 100*time.Millisecond, 1)
+		storage.IncrementWindows(ctx, "windows", []Window{{Limit: 10, Period: time.Second}}, 1, BlockPolicy{Duration: time.Second})
+		storage.ConsumeQuota(ctx, "quota", 1, 10, storage.now().Add(time.Second))
+		if length := storage.Len(); length != 6 {
+			t.Fatalf("Expected 6 keys, got %d", length)
+		}
+
+		advance(2 * time.Second)
+		if removed := storage.RemoveExpired(); removed != 6 {
+			t.Errorf("Expected 6 expired keys to be removed, got %d", removed)
+		}
+		if length := storage.Len(); length != 0 {
+			t.Errorf("Expected no keys, got %d", length)
+		}
+	})
+
+	t.Run("Expired keys are removed in the background", func(t *testing.T) {
+		storage := NewMemoryStorage(WithCleanupInterval(10 * time.Millisecond))
+		defer storage.Close()
+
+		storage.Block(ctx, "background", time.Millisecond)
+		deadline := time.Now().Add(time.Second)
+		for storage.Len() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the expired key to be removed in the background")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+}
+
+func TestMemoryStorage_Eviction(t *testing.T) {
+	ctx := context.Background()
+	storage, _ := setupTestMemory(t, WithShards(1), WithMaxKeys(3))
+
+	for _, key := range []string{"a", "b", "c"} {
+		storage.Increment(ctx, key, time.Minute)
+	}
+
+	// Reading a key makes it recently used, b is the least recently used
+	storage.Increment(ctx, "a", time.Minute)
+	storage.Increment(ctx, "d", time.Minute)
+
+	if length := storage.Len(); length != 3 {
+		t.Errorf("Expected the storage to be capped at 3 keys, got %d", length)
+	}
+	if count, _ := storage.Increment(ctx, "b", time.Minute); count != 1 {
+		t.Errorf("Expected b to be evicted, got count %d", count)
+	}
+	if count, _ := storage.Increment(ctx, "a", time.Minute); count != 3 {
+		t.Errorf("Expected a to be kept, got count %d", count)
+	}
+
+	// Flooding the storage with new keys does not lift a block
+	storage.Block(ctx, "abuser", time.Minute)
+	for i := 0; i < 10; i++ {
+		storage.Increment(ctx, fmt.Sprintf("flood-%d", i), time.Minute)
+	}
+	if ttl, _ := storage.BlockTTL(ctx, "abuser"); ttl != time.Minute {
+		t.Errorf("Expected the block to survive the eviction, got %v", ttl)
+	}
+	if result, _ := storage.FixedWindow(ctx, "abuser", 10, time.Minute, 1, BlockPolicy{Duration: time.Minute}); result.Allowed {
+		t.Error("Expected the key to remain blocked")
+	}
+}
+
+func TestMemoryStorage_FixedWindow(t *testing.T) {
+	ctx := context.Background()
+	block := BlockPolicy{Duration: time.Minute}
+
+	t.Run("Counts and blocks in one call", func(t *testing.T) {
+		storage, advance := setupTestMemory(t)
+
+		for i := int64(1); i <= 3; i++ {
+			result, _ := storage.FixedWindow(ctx, "fixed", 3, time.Second, 1, block)
+			if !result.Allowed || result.Remaining != 3-i || result.ResetAfter != time.Second {
+				t.Errorf("Request %d: expected to be allowed with %d remaining, got %+v", i, 3-i, result)
+			}
+		}
+
+		result, _ := storage.FixedWindow(ctx, "fixed", 3, time.Second, 1, block)
+		if result.Allowed || result.RetryAfter != time.Minute {
+			t.Errorf("Expected the key to be blocked for a minute, got %+v", result)
+		}
+
+		advance(10 * time.Second)
+		result, _ = storage.FixedWindow(ctx, "fixed", 3, time.Second, 1, block)
+		if result.Allowed || result.RetryAfter != 50*time.Second {
+			t.Errorf("Expected the remaining block to be reported, got %+v", result)
+		}
+
+		advance(50 * time.Second)
+		result, _ = storage.FixedWindow(ctx, "fixed", 3, time.Second, 1, block)
+		if !result.Allowed || result.Remaining != 2 {
+			t.Errorf("Expected a new window after the block, got %+v", result)
+		}
+	})
+
+	t.Run("Requests that do not fit are rejected without being counted", func(t *testing.T) {
+		storage, _ := setupTestMemory(t)
+
+		storage.FixedWindow(ctx, "cost", 10, time.Second, 8, block)
+		result, _ := storage.FixedWindow(ctx, "cost", 10, time.Second, 3, block)
+		if result.Allowed || result.Remaining != 2 || result.RetryAfter != time.Second {
+			t.Errorf("Expected the request to be rejected until the window resets, got %+v", result)
+		}
+
+		// The key is not blocked and its allowance is intact
+		result, _ = storage.FixedWindow(ctx, "cost", 10, time.Second, 2, block)
+		if !result.Allowed || result.Remaining != 0 {
+			t.Errorf("Expected the remaining cost to be allowed, got %+v", result)
+		}
+		result, _ = storage.FixedWindow(ctx, "cost", 10, time.Second, 1, block)
+		if result.Allowed || result.RetryAfter != time.Minute {
+			t.Errorf("Expected the key at its limit to be blocked, got %+v", result)
+		}
+	})
+
+	t.Run("Blocks escalate with penalties", func(t *testing.T) {
+		storage, advance := setupTestMemory(t)
+		escalating := BlockPolicy{Duration: time.Minute, Multiplier: 3, MaxDuration: 5 * time.Minute, Decay: time.Hour}
+
+		for _, expected := range []time.Duration{time.Minute, 3 * time.Minute, 5 * time.Minute} {
+			result, _ := storage.FixedWindow(ctx, "penalty", 0, time.Second, 1, escalating)
+			if result.RetryAfter != expected {
+				t.Errorf("Expected a block of %v, got %v", expected, result.RetryAfter)
+			}
+			advance(result.RetryAfter)
+		}
+
+		advance(time.Hour)
+		if result, _ := storage.FixedWindow(ctx, "penalty", 0, time.Second, 1, escalating); result.RetryAfter != time.Minute {
+			t.Errorf("Expected the violations to decay, got a block of %v", result.RetryAfter)
+		}
+	})
+
+	t.Run("Concurrent requests never exceed the limit", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		defer storage.Close()
+
+		var allowed atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			for j := 0; j < 20; j++ {
+				wg.Add(1)
+				go func(key string) {
+					defer wg.Done()
+					result, _ := storage.FixedWindow(ctx, key, 10, time.Minute, 1, block)
+					if result.Allowed {
+						allowed.Add(1)
+					}
+				}(fmt.Sprintf("concurrent-%d", i))
+			}
+		}
+		wg.Wait()
+
+		if allowed.Load() != 500 {
+			t.Errorf("Expected 10 allowed requests for each of the 50 keys, got %d in total", allowed.Load())
+		}
+	})
+}
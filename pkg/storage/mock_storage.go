@@ -7,26 +7,54 @@ import (
 )
 
 type MockStorage struct {
-	counters    map[string]int64
+	counters    map[string]*fixedWindow
 	blocked     map[string]time.Time
+	buckets     map[string]*bucket
+	logs        map[string]*windowLog
+	windows     map[string]*windowCounter
+	arrivals    map[string]time.Time
+	windowSets  map[string]map[time.Duration]*fixedWindow
+	quotas      map[string]*fixedWindow
+	violations  map[string]*fixedWindow
 	mutex       sync.RWMutex
 	currentTime time.Time
 }
 
 func NewMockStorage() *MockStorage {
 	return &MockStorage{
-		counters:    make(map[string]int64),
+		counters:    make(map[string]*fixedWindow),
 		blocked:     make(map[string]time.Time),
+		buckets:     make(map[string]*bucket),
+		logs:        make(map[string]*windowLog),
+		windows:     make(map[string]*windowCounter),
+		arrivals:    make(map[string]time.Time),
+		windowSets:  make(map[string]map[time.Duration]*fixedWindow),
+		quotas:      make(map[string]*fixedWindow),
+		violations:  make(map[string]*fixedWindow),
 		currentTime: time.Now(),
 	}
 }
 
 func (m *MockStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return m.IncrementBy(ctx, key, 1, expiration)
+}
+
+func (m *MockStorage) IncrementBy(ctx context.Context, key string, amount int64, expiration time.Duration) (int64, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.counters[key]++
-	return m.counters[key], nil
+	return m.counter(key, expiration).add(amount), nil
+}
+
+// counter returns the counter of a key, starting a new window with the given
+// expiration when it has none or it expired. The mutex must be held
+func (m *MockStorage) counter(key string, expiration time.Duration) *fixedWindow {
+	counter, exists := m.counters[key]
+	if !exists || !counter.expires.After(m.currentTime) {
+		counter = &fixedWindow{expires: m.currentTime.Add(expiration)}
+		m.counters[key] = counter
+	}
+	return counter
 }
 
 func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
@@ -39,6 +67,16 @@ func (m *MockStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
 	return false, nil
 }
 
+func (m *MockStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if blockTime, exists := m.blocked[key]; exists && blockTime.After(m.currentTime) {
+		return blockTime.Sub(m.currentTime), nil
+	}
+	return 0, nil
+}
+
 func (m *MockStorage) Block(ctx context.Context, key string, duration time.Duration) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -47,15 +85,193 @@ func (m *MockStorage) Block(ctx context.Context, key string, duration time.Durat
 	return nil
 }
 
+// Reset clears the states of a key like the other storages do, keeping its window
+// counters and violations
 func (m *MockStorage) Reset(ctx context.Context, key string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	delete(m.counters, key)
 	delete(m.blocked, key)
+	delete(m.buckets, key)
+	delete(m.logs, key)
+	delete(m.windows, key)
+	delete(m.arrivals, key)
+	delete(m.quotas, key)
 	return nil
 }
 
+func (m *MockStorage) TakeToken(ctx context.Context, key string, capacity int64, rate float64, cost int64) (Result, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b, exists := m.buckets[key]
+	if !exists {
+		b = &bucket{}
+		m.buckets[key] = b
+	}
+	return takeToken(b, m.currentTime, capacity, rate, cost), nil
+}
+
+func (m *MockStorage) SlidingWindowLog(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	l, exists := m.logs[key]
+	if !exists {
+		l = &windowLog{}
+		m.logs[key] = l
+	}
+	return slidingWindowLog(l, m.currentTime, limit, window, cost), nil
+}
+
+func (m *MockStorage) SlidingWindowCounter(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, exists := m.windows[key]
+	if !exists {
+		c = &windowCounter{}
+		m.windows[key] = c
+	}
+	return slidingWindowCounter(c, m.currentTime, limit, window, cost), nil
+}
+
+func (m *MockStorage) GCRA(ctx context.Context, key string, burst int64, interval time.Duration, cost int64) (Result, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tat := m.arrivals[key]
+	result := gcra(&tat, m.currentTime, burst, interval, cost)
+	m.arrivals[key] = tat
+	return result, nil
+}
+
+// IncrementWindows keeps the counters of every window apart from the other
+// states of the key, so Reset does not clear them, like the other storages
+func (m *MockStorage) IncrementWindows(ctx context.Context, key string, windows []Window, cost int64, block BlockPolicy) (WindowsResult, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if blockTime, exists := m.blocked[key]; exists && blockTime.After(m.currentTime) {
+		return WindowsResult{Blocked: blockTime.Sub(m.currentTime)}, nil
+	}
+
+	set, exists := m.windowSets[key]
+	if !exists {
+		set = make(map[time.Duration]*fixedWindow)
+		m.windowSets[key] = set
+	}
+
+	counters := make([]*fixedWindow, len(windows))
+	for i, window := range windows {
+		if set[window.Period] == nil {
+			set[window.Period] = &fixedWindow{}
+		}
+		counters[i] = set[window.Period]
+	}
+
+	counts, exceeded := incrementWindows(counters, m.currentTime, windows, cost)
+	result := WindowsResult{Counts: counts, Exceeded: exceeded}
+	if exceeded == 0 && counts[0].Count >= windows[0].Limit {
+		result.Blocked = m.block(key, block)
+	}
+	return result, nil
+}
+
+func (m *MockStorage) ConsumeQuota(ctx context.Context, key string, amount, limit int64, expiresAt time.Time) (int64, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	usage, exists := m.quotas[key]
+	if !exists || !usage.expires.After(m.currentTime) {
+		usage = &fixedWindow{}
+		m.quotas[key] = usage
+	}
+
+	if amount > 0 && usage.count+amount > limit {
+		return usage.count, false, nil
+	}
+
+	usage.count += amount
+	usage.expires = expiresAt
+	return usage.count, true, nil
+}
+
+func (m *MockStorage) QuotaUsage(ctx context.Context, key string) (int64, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if usage, exists := m.quotas[key]; exists && usage.expires.After(m.currentTime) {
+		return usage.count, nil
+	}
+	return 0, nil
+}
+
+func (m *MockStorage) FixedWindow(ctx context.Context, key string, limit int64, window time.Duration, cost int64, block BlockPolicy) (Result, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if blockTime, exists := m.blocked[key]; exists && blockTime.After(m.currentTime) {
+		remaining := blockTime.Sub(m.currentTime)
+		return Result{RetryAfter: remaining, ResetAfter: remaining}, nil
+	}
+
+	counter := m.counter(key, window)
+	if counter.count+cost <= limit {
+		counter.add(cost)
+		return Result{
+			Allowed:    true,
+			Remaining:  limit - counter.count,
+			ResetAfter: counter.expires.Sub(m.currentTime),
+		}, nil
+	}
+
+	// A request whose cost does not fit is rejected without being counted, the key
+	// is only blocked once it has used its whole limit
+	if counter.count < limit {
+		reset := counter.expires.Sub(m.currentTime)
+		return Result{Remaining: limit - counter.count, RetryAfter: reset, ResetAfter: reset}, nil
+	}
+
+	delete(m.counters, key)
+	duration := m.block(key, block)
+	return Result{RetryAfter: duration, ResetAfter: duration}, nil
+}
+
+// block blocks a key according to the block policy and returns for how long, the
+// mutex must be held
+func (m *MockStorage) block(key string, block BlockPolicy) time.Duration {
+	violations := int64(1)
+	if block.Multiplier > 0 {
+		violations = m.addViolation(key, block.Decay)
+	}
+
+	duration := block.For(violations)
+	m.blocked[key] = m.currentTime.Add(duration)
+	return duration
+}
+
+func (m *MockStorage) AddViolation(ctx context.Context, key string, decay time.Duration) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.addViolation(key, decay), nil
+}
+
+// addViolation records a violation, the mutex must be held
+func (m *MockStorage) addViolation(key string, decay time.Duration) int64 {
+	history, exists := m.violations[key]
+	if !exists || !history.expires.After(m.currentTime) {
+		history = &fixedWindow{}
+		m.violations[key] = history
+	}
+
+	history.count++
+	history.expires = m.currentTime.Add(decay)
+	return history.count
+}
+
 func (m *MockStorage) Close() error {
 	return nil
 }
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMockStorage_SustainedTraffic(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMockStorage()
+	storage.SetCurrentTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// Ten requests per second for a minute, with a one second window. Every
+	// window restarts with its first request and counts ten requests at most
+	for i := 1; i <= 600; i++ {
+		count, err := storage.Increment(ctx, "sustained", time.Second)
+		if err != nil {
+			t.Fatalf("Failed to increment: %v", err)
+		}
+		if expected := int64((i-1)%10 + 1); count != expected {
+			t.Fatalf("Request %d: expected count %d, got %d", i, expected, count)
+		}
+		storage.AdvanceTime(100 * time.Millisecond)
+	}
+
+	// Costs share the same windows
+	storage.AdvanceTime(time.Second)
+	for i := 1; i <= 20; i++ {
+		count, _ := storage.IncrementBy(ctx, "sustained", 5, time.Second)
+		if expected := int64((i-1)%10+1) * 5; count != expected {
+			t.Fatalf("Request %d: expected count %d, got %d", i, expected, count)
+		}
+		storage.AdvanceTime(100 * time.Millisecond)
+	}
+}
+
+func TestMockStorage_ResetKeepsWindows(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMockStorage()
+	windows := []Window{{Limit: 2, Period: time.Second}, {Limit: 3, Period: time.Minute}}
+
+	storage.IncrementWindows(ctx, "reset", windows, 2, BlockPolicy{Duration: time.Minute})
+	if err := storage.Reset(ctx, "reset"); err != nil {
+		t.Fatalf("Failed to reset: %v", err)
+	}
+
+	// Like Redis and memory storages, the window counters expire with their window
+	result, _ := storage.IncrementWindows(ctx, "reset", windows, 1, BlockPolicy{Duration: time.Minute})
+	if result.Exceeded != 0 || result.Counts[0].Count != 2 {
+		t.Errorf("Expected the window counters to be kept, got %+v", result)
+	}
+}
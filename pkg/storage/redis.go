@@ -2,57 +2,414 @@ package storage
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
+// takeTokenScript refills and takes tokens from a bucket stored as a hash with the
+// current amount of tokens and the time of the last refill in milliseconds
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1])
+local updated = tonumber(state[2])
+if tokens == nil or updated == nil then
+	tokens = capacity
+	updated = now
+end
+
+if now > updated then
+	tokens = math.min(capacity, tokens + (now - updated) * rate / 1000)
+	updated = now
+end
+
+local allowed = 0
+local retry = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+else
+	retry = math.ceil((cost - tokens) * 1000 / rate)
+end
+
+local reset = math.ceil((capacity - tokens) * 1000 / rate)
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(updated))
+redis.call('PEXPIRE', KEYS[1], math.max(reset, 1))
+
+return {allowed, math.floor(tokens), retry, reset}
+`)
+
+// slidingWindowLogScript keeps the allowed requests of a key in a sorted set scored
+// by their time in microseconds. Scores are formatted explicitly because Lua numbers
+// are converted with 14 significant digits
+var slidingWindowLogScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[4])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', string.format('%d', now - window))
+local count = redis.call('ZCARD', KEYS[1])
+
+local allowed = 0
+local retry = 0
+if count + cost <= limit then
+	for i = 1, cost do
+		redis.call('ZADD', KEYS[1], string.format('%d', now), ARGV[3] .. ':' .. i)
+	end
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+	count = count + cost
+	allowed = 1
+elseif count + cost - limit <= count then
+	local leaving = redis.call('ZRANGE', KEYS[1], count + cost - limit - 1, count + cost - limit - 1, 'WITHSCORES')
+	retry = tonumber(leaving[2]) + window - now
+end
+
+local reset = 0
+if count > 0 then
+	local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	reset = tonumber(newest[2]) + window - now
+end
+
+return {allowed, math.max(limit - count, 0), retry, reset}
+`)
+
+// slidingWindowCounterScript keeps the index of the current fixed window of a key
+// in a hash together with its count and the count of the previous window
+var slidingWindowCounterScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local index = math.floor(now / window)
+
+local state = redis.call('HMGET', KEYS[1], 'window', 'current', 'previous')
+local stored = tonumber(state[1])
+local current = tonumber(state[2]) or 0
+local previous = tonumber(state[3]) or 0
+if stored ~= index then
+	if stored == index - 1 then
+		previous = current
+	else
+		previous = 0
+	end
+	current = 0
+end
+
+local elapsed = now - index * window
+local estimated = previous * (1 - elapsed / window) + current
+
+local allowed = 0
+local retry = 0
+if estimated + cost <= limit then
+	current = current + cost
+	estimated = estimated + cost
+	allowed = 1
+elseif current + cost <= limit and previous > 0 then
+	retry = (1 - (limit - current - cost) / previous) * window - elapsed
+else
+	retry = window - elapsed
+end
+
+local reset = 0
+if current > 0 then
+	reset = 2 * window - elapsed
+elseif previous > 0 then
+	reset = window - elapsed
+end
+
+redis.call('HSET', KEYS[1], 'window', index, 'current', current, 'previous', previous)
+redis.call('PEXPIRE', KEYS[1], math.ceil(2 * window / 1000))
+
+return {allowed, math.max(math.floor(limit - estimated), 0), math.floor(retry), reset}
+`)
+
+// gcraScript keeps the theoretical arrival time of a key in microseconds as its only state
+var gcraScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local tolerance = burst * interval
+local new_tat = tat + cost * interval
+local allow_at = new_tat - tolerance
+if now < allow_at then
+	return {0, math.floor((tolerance - (tat - now)) / interval), allow_at - now, tat - now}
+end
+
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / interval), 0, new_tat - now}
+`)
+
+// incrementWindowsScript checks the block of a key and adds the cost in ARGV[1]
+// to one counter per window, unless a window would exceed its limit, in a single
+// round trip. KEYS are the counters followed by the block and the violations,
+// ARGV[2] to ARGV[5] the block policy as in blockScript, then the limit and period
+// in milliseconds of each window as pairs
+var incrementWindowsScript = redis.NewScript(blockScript + `
+local windows = #KEYS - 2
+local blocked = redis.call('PTTL', KEYS[windows + 1])
+if blocked == -1 then
+	blocked = tonumber(ARGV[2])
+end
+if blocked >= 0 then
+	return {math.max(blocked, 1), 0}
+end
+
+local cost = tonumber(ARGV[1])
+local exceeded = -1
+local counts = {}
+for i = 1, windows do
+	counts[i] = tonumber(redis.call('GET', KEYS[i]) or '0')
+	if exceeded == -1 and counts[i] + cost > tonumber(ARGV[4 + i * 2]) then
+		exceeded = i - 1
+	end
+end
+
+local result = {0, exceeded}
+for i = 1, windows do
+	if exceeded == -1 then
+		counts[i] = redis.call('INCRBY', KEYS[i], cost)
+		if counts[i] == cost then
+			redis.call('PEXPIRE', KEYS[i], ARGV[5 + i * 2])
+		end
+	end
+
+	local ttl = redis.call('PTTL', KEYS[i])
+	if ttl < 0 then
+		ttl = 0
+	end
+	table.insert(result, counts[i])
+	table.insert(result, ttl)
+end
+
+-- Only a key that had already reached the limit of the first window is blocked,
+-- the other windows reject requests until they reset
+if exceeded == 0 and counts[1] >= tonumber(ARGV[6]) then
+	result[1] = block(KEYS[windows + 1], KEYS[windows + 2], 2)
+end
+
+return result
+`)
+
+// consumeQuotaScript adds ARGV[1] to the usage in KEYS[1] unless it would exceed
+// the limit in ARGV[2], and makes it expire at the Unix time in ms in ARGV[3]
+var consumeQuotaScript = redis.NewScript(`
+local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+local amount = tonumber(ARGV[1])
+
+if amount > 0 and used + amount > tonumber(ARGV[2]) then
+	return {used, 0}
+end
+
+used = redis.call('INCRBY', KEYS[1], amount)
+redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+return {used, 1}
+`)
+
+// incrementScript adds ARGV[1] to the counter in KEYS[1] and sets its expiration in
+// milliseconds in ARGV[2] on the first increment only, so the window starts with
+// the first request instead of sliding with every request
+var incrementScript = redis.NewScript(`
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return count
+`)
+
+// blockScript defines block, which blocks a key and returns the block duration.
+// The block policy is read from ARGV starting at first: the duration, multiplier,
+// maximum duration and decay, durations in milliseconds. A violation is recorded
+// when the multiplier is positive
+const blockScript = `
+local function block(blocked, violations, first)
+	local duration = tonumber(ARGV[first])
+	local multiplier = tonumber(ARGV[first + 1])
+	if multiplier > 0 then
+		local count = redis.call('INCR', violations)
+		if tonumber(ARGV[first + 3]) > 0 then
+			redis.call('PEXPIRE', violations, ARGV[first + 3])
+		end
+		duration = duration * math.pow(multiplier, count - 1)
+		local max = tonumber(ARGV[first + 2])
+		if max > 0 and duration > max then
+			duration = max
+		end
+	end
+
+	-- Numbers are formatted explicitly because Lua converts them with 14 significant digits
+	duration = math.min(math.floor(duration), 9007199254740991)
+	redis.call('SET', blocked, '1', 'PX', string.format('%d', math.max(duration, 1)))
+	return duration
+end
+`
+
+// fixedWindowScript checks the block of a key, counts the cost in ARGV[3] in its
+// window when it fits in the limit and blocks the key once it is over its limit,
+// in a single round trip. KEYS are the counter, the block and the violations, ARGV
+// the limit, window, cost and the block policy as in blockScript, durations in
+// milliseconds
+var fixedWindowScript = redis.NewScript(blockScript + `
+local blocked = redis.call('PTTL', KEYS[2])
+if blocked == -1 then
+	blocked = tonumber(ARGV[4])
+end
+if blocked >= 0 then
+	return {0, 0, blocked, blocked}
+end
+
+local limit = tonumber(ARGV[1])
+local cost = tonumber(ARGV[3])
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count + cost <= limit then
+	count = redis.call('INCRBY', KEYS[1], cost)
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl < 0 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		ttl = tonumber(ARGV[2])
+	end
+	return {1, limit - count, 0, ttl}
+end
+
+-- A request whose cost does not fit is rejected without being counted, the key is
+-- only blocked once it has used its whole limit
+if count < limit then
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl < 0 then
+		ttl = tonumber(ARGV[2])
+	end
+	return {0, limit - count, ttl, ttl}
+end
+
+redis.call('DEL', KEYS[1])
+local duration = block(KEYS[2], KEYS[3], 4)
+return {0, 0, duration, duration}
+`)
+
+// RedisStorage keeps the state of the rate limiter in Redis, a single node, a
+// Sentinel monitored master or a Cluster. Every key derived from a rate limiter
+// key wraps it in a hash tag, such as {key} and blocked:{key}, so they all land
+// in the same Cluster slot and scripts can use them together
 type RedisStorage struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
+// NewRedisStorage connects to a single Redis node, see NewRedisStorageWithOptions
+// for TLS, ACL users, timeouts and pool settings
 func NewRedisStorage(host string, port int, password string, db int) (*RedisStorage, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", host, port),
-		Password: password,
-		DB:       db,
-	})
-
-	// Test connection
-	ctx := context.Background()
-	if err := client.Ping(ctx).Err(); err != nil {
+	return NewRedisStorageWithOptions(
+		WithAddr(fmt.Sprintf("%s:%d", host, port)),
+		WithCredentials("", password),
+		WithDB(db),
+	)
+}
+
+// NewRedisSentinelStorage connects to the master named masterName through the
+// Sentinels at sentinelAddrs, following failovers. password is the password of
+// the Redis nodes, Sentinels with a password need WithSentinelCredentials
+func NewRedisSentinelStorage(masterName string, sentinelAddrs []string, password string, db int) (*RedisStorage, error) {
+	return NewRedisStorageWithOptions(
+		WithSentinel(masterName, sentinelAddrs...),
+		WithCredentials("", password),
+		WithDB(db),
+	)
+}
+
+// NewRedisClusterStorage connects to a Redis Cluster through some of its nodes
+func NewRedisClusterStorage(addrs []string, password string) (*RedisStorage, error) {
+	return NewRedisStorageWithOptions(WithCluster(addrs...), WithCredentials("", password))
+}
+
+// NewRedisStorageFromClient uses a client built by the caller, such as one from
+// redis.NewUniversalClient. The client is closed by Close
+func NewRedisStorageFromClient(client redis.UniversalClient) (*RedisStorage, error) {
+	if err := client.Ping(context.Background()).Err(); err != nil {
 		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
 	}
-
 	return &RedisStorage{client: client}, nil
 }
 
+// connect tests the connection of a client built by the storage, closing it when
+// Redis is unreachable
+func connect(client redis.UniversalClient) (*RedisStorage, error) {
+	storage, err := NewRedisStorageFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// redisKey names a Redis key derived from a rate limiter key, with an optional
+// prefix such as "blocked:". The key is hex encoded into a hash tag, so its derived
+// keys share a Cluster slot even when the key, which may come from the client,
+// contains braces. The empty key is tagged "-", as an empty tag is not a hash tag
+func redisKey(prefix, key string) string {
+	tag := hex.EncodeToString([]byte(key))
+	if tag == "" {
+		tag = "-"
+	}
+	return prefix + "{" + tag + "}"
+}
+
 func (r *RedisStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
-	pipe := r.client.Pipeline()
-	incr := pipe.Incr(ctx, key)
-	pipe.Expire(ctx, key, expiration)
-	
-	_, err := pipe.Exec(ctx)
+	return r.IncrementBy(ctx, key, 1, expiration)
+}
+
+func (r *RedisStorage) IncrementBy(ctx context.Context, key string, amount int64, expiration time.Duration) (int64, error) {
+	count, err := incrementScript.Run(ctx, r.client, []string{redisKey("", key)}, amount, expiration.Milliseconds()).Int64()
 	if err != nil {
 		return 0, fmt.Errorf("failed to increment key: %v", err)
 	}
-	
-	return incr.Val(), nil
+	return count, nil
 }
 
 func (r *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	blockedKey := fmt.Sprintf("blocked:%s", key)
-	exists, err := r.client.Exists(ctx, blockedKey).Result()
+	exists, err := r.client.Exists(ctx, redisKey("blocked:", key)).Result()
 	if err != nil {
 		return false, fmt.Errorf("failed to check blocked status: %v", err)
 	}
 	return exists == 1, nil
 }
 
+func (r *RedisStorage) BlockTTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := r.client.PTTL(ctx, redisKey("blocked:", key)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get block TTL: %v", err)
+	}
+
+	switch {
+	case ttl == -2:
+		// Key does not exist
+		return 0, nil
+	case ttl < 0:
+		// Key exists without expiration
+		return -1, nil
+	}
+	return ttl, nil
+}
+
 func (r *RedisStorage) Block(ctx context.Context, key string, duration time.Duration) error {
-	blockedKey := fmt.Sprintf("blocked:%s", key)
-	err := r.client.Set(ctx, blockedKey, "1", duration).Err()
+	err := r.client.Set(ctx, redisKey("blocked:", key), "1", duration).Err()
 	if err != nil {
 		return fmt.Errorf("failed to set block: %v", err)
 	}
@@ -60,19 +417,171 @@ func (r *RedisStorage) Block(ctx context.Context, key string, duration time.Dura
 }
 
 func (r *RedisStorage) Reset(ctx context.Context, key string) error {
-	pipe := r.client.Pipeline()
-	
-	// Delete both the counter key and the blocked key
-	pipe.Del(ctx, key)
-	pipe.Del(ctx, fmt.Sprintf("blocked:%s", key))
-	
-	_, err := pipe.Exec(ctx)
+	// Delete the counter key, the blocked key and the algorithm states, in one
+	// command since they share a slot
+	err := r.client.Del(ctx,
+		redisKey("", key),
+		redisKey("blocked:", key),
+		redisKey("bucket:", key),
+		redisKey("log:", key),
+		redisKey("window:", key),
+		redisKey("gcra:", key),
+	).Err()
 	if err != nil {
 		return fmt.Errorf("failed to reset keys: %v", err)
 	}
 	return nil
 }
 
+func (r *RedisStorage) TakeToken(ctx context.Context, key string, capacity int64, rate float64, cost int64) (Result, error) {
+	values, err := takeTokenScript.Run(ctx, r.client, []string{redisKey("bucket:", key)}, capacity, rate, cost).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to take token: %v", err)
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+func (r *RedisStorage) SlidingWindowLog(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error) {
+	member := fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+	values, err := slidingWindowLogScript.Run(ctx, r.client, []string{redisKey("log:", key)}, limit, window.Microseconds(), member, cost).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to run sliding window log: %v", err)
+	}
+
+	return microsecondsResult(values), nil
+}
+
+func (r *RedisStorage) SlidingWindowCounter(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error) {
+	values, err := slidingWindowCounterScript.Run(ctx, r.client, []string{redisKey("window:", key)}, limit, window.Microseconds(), cost).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to run sliding window counter: %v", err)
+	}
+
+	return microsecondsResult(values), nil
+}
+
+// GCRA keeps the arrival time in microseconds, so intervals shorter than a
+// microsecond are rounded up to one instead of dividing by zero in the script
+func (r *RedisStorage) GCRA(ctx context.Context, key string, burst int64, interval time.Duration, cost int64) (Result, error) {
+	microseconds := interval.Microseconds()
+	if microseconds < 1 {
+		microseconds = 1
+	}
+
+	values, err := gcraScript.Run(ctx, r.client, []string{redisKey("gcra:", key)}, burst, microseconds, cost).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to run GCRA: %v", err)
+	}
+
+	return microsecondsResult(values), nil
+}
+
+// IncrementWindows keeps one counter per window, named after the key and the
+// window period. Reset does not clear them, they expire with their window
+func (r *RedisStorage) IncrementWindows(ctx context.Context, key string, windows []Window, cost int64, block BlockPolicy) (WindowsResult, error) {
+	keys := make([]string, 0, len(windows)+2)
+	args := make([]interface{}, 0, len(windows)*2+5)
+	args = append(args, cost,
+		block.Duration.Milliseconds(), block.Multiplier, block.MaxDuration.Milliseconds(), block.Decay.Milliseconds(),
+	)
+	for _, window := range windows {
+		keys = append(keys, redisKey(fmt.Sprintf("windows:%d:", window.Period.Milliseconds()), key))
+		args = append(args, window.Limit, window.Period.Milliseconds())
+	}
+	keys = append(keys, redisKey("blocked:", key), redisKey("violations:", key))
+
+	values, err := incrementWindowsScript.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return WindowsResult{}, fmt.Errorf("failed to increment windows: %v", err)
+	}
+
+	result := WindowsResult{
+		Exceeded: int(values[1]),
+		Blocked:  time.Duration(values[0]) * time.Millisecond,
+	}
+	if len(values) > 2 {
+		result.Counts = make([]WindowCount, len(windows))
+		for i := range result.Counts {
+			result.Counts[i] = WindowCount{
+				Count:      values[2+i*2],
+				ResetAfter: time.Duration(values[3+i*2]) * time.Millisecond,
+			}
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisStorage) ConsumeQuota(ctx context.Context, key string, amount, limit int64, expiresAt time.Time) (int64, bool, error) {
+	values, err := consumeQuotaScript.Run(ctx, r.client, []string{redisKey("", key)}, amount, limit, expiresAt.UnixMilli()).Int64Slice()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to consume quota: %v", err)
+	}
+	return values[0], values[1] == 1, nil
+}
+
+func (r *RedisStorage) QuotaUsage(ctx context.Context, key string) (int64, error) {
+	used, err := r.client.Get(ctx, redisKey("", key)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get quota usage: %v", err)
+	}
+	return used, nil
+}
+
+func (r *RedisStorage) FixedWindow(ctx context.Context, key string, limit int64, window time.Duration, cost int64, block BlockPolicy) (Result, error) {
+	keys := []string{redisKey("", key), redisKey("blocked:", key), redisKey("violations:", key)}
+	values, err := fixedWindowScript.Run(ctx, r.client, keys,
+		limit, window.Milliseconds(), cost,
+		block.Duration.Milliseconds(), block.Multiplier, block.MaxDuration.Milliseconds(), block.Decay.Milliseconds(),
+	).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to check fixed window: %v", err)
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+func (r *RedisStorage) AddViolation(ctx context.Context, key string, decay time.Duration) (int64, error) {
+	violationsKey := redisKey("violations:", key)
+
+	pipe := r.client.Pipeline()
+	incr := pipe.Incr(ctx, violationsKey)
+	pipe.PExpire(ctx, violationsKey, decay)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to add violation: %v", err)
+	}
+	return incr.Val(), nil
+}
+
+// microsecondsResult converts the {allowed, remaining, retry, reset} reply of a
+// script that measures time in microseconds
+func microsecondsResult(values []int64) Result {
+	return Result{
+		Allowed:    values[0] == 1,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Microsecond,
+		ResetAfter: time.Duration(values[3]) * time.Microsecond,
+	}
+}
+
+// Client returns the underlying Redis client, to be shared with other components
+func (r *RedisStorage) Client() redis.UniversalClient {
+	return r.client
+}
+
 func (r *RedisStorage) Close() error {
 	return r.client.Close()
 }
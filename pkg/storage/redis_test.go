@@ -3,9 +3,13 @@ package storage
 import (
 	"context"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
 )
 
@@ -63,7 +67,7 @@ func TestRedisStorage_Integration(t *testing.T) {
 			}
 		}
 
-		ttl, err := storage.client.TTL(ctx, ip).Result()
+		ttl, err := storage.client.TTL(ctx, redisKey("", ip)).Result()
 		if err != nil {
 			t.Fatalf("Failed to get TTL: %v", err)
 		}
@@ -126,7 +130,7 @@ func TestRedisStorage_Integration(t *testing.T) {
 			t.Fatalf("Failed to reset token: %v", err)
 		}
 
-		count, err := storage.client.Get(ctx, token).Int64()
+		count, err := storage.client.Get(ctx, redisKey("", token)).Int64()
 		if err == nil {
 			t.Errorf("Expected key to be deleted, but got count %d", count)
 		}
@@ -162,7 +166,7 @@ func TestRedisStorage_Integration(t *testing.T) {
 			<-done
 		}
 
-		count, err := storage.client.Get(ctx, key).Int64()
+		count, err := storage.client.Get(ctx, redisKey("", key)).Int64()
 		if err != nil {
 			t.Fatalf("Failed to get final count: %v", err)
 		}
@@ -249,6 +253,586 @@ func TestRedisStorage_Integration(t *testing.T) {
 	})
 }
 
+func TestRedisStorage_BlockTTL(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := "block-ttl-test"
+
+	ttl, err := storage.BlockTTL(ctx, key)
+	if err != nil {
+		t.Fatalf("Failed to get block TTL: %v", err)
+	}
+	if ttl != 0 {
+		t.Errorf("Expected zero TTL for a key that is not blocked, got %v", ttl)
+	}
+
+	if err := storage.Block(ctx, key, 5*time.Second); err != nil {
+		t.Fatalf("Failed to block key: %v", err)
+	}
+
+	ttl, err = storage.BlockTTL(ctx, key)
+	if err != nil {
+		t.Fatalf("Failed to get block TTL: %v", err)
+	}
+	if ttl <= 4*time.Second || ttl > 5*time.Second {
+		t.Errorf("Expected TTL close to 5s, got %v", ttl)
+	}
+}
+
+func TestRedisStorage_TokenBucket(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := "token-bucket-test"
+
+	for i := 0; i < 3; i++ {
+		result, err := storage.TakeToken(ctx, key, 3, 1, 1)
+		if err != nil {
+			t.Fatalf("Failed to take token: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected token %d to be available", i+1)
+		}
+		if result.Remaining != int64(2-i) {
+			t.Errorf("Expected %d remaining tokens, got %d", 2-i, result.Remaining)
+		}
+	}
+
+	result, err := storage.TakeToken(ctx, key, 3, 1, 1)
+	if err != nil {
+		t.Fatalf("Failed to take token: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected bucket to be empty")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("Expected retry after to be within a second, got %v", result.RetryAfter)
+	}
+
+	time.Sleep(result.RetryAfter + 100*time.Millisecond)
+
+	result, err = storage.TakeToken(ctx, key, 3, 1, 1)
+	if err != nil {
+		t.Fatalf("Failed to take token: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected a token to be refilled")
+	}
+}
+
+func TestRedisStorage_SlidingWindow(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	window := time.Second
+
+	t.Run("Sliding window log", func(t *testing.T) {
+		key := "sliding-log-test"
+
+		for i := 0; i < 3; i++ {
+			result, err := storage.SlidingWindowLog(ctx, key, 3, window, 1)
+			if err != nil {
+				t.Fatalf("Failed to run sliding window log: %v", err)
+			}
+			if !result.Allowed {
+				t.Errorf("Expected request %d to be allowed", i+1)
+			}
+		}
+
+		result, err := storage.SlidingWindowLog(ctx, key, 3, window, 1)
+		if err != nil {
+			t.Fatalf("Failed to run sliding window log: %v", err)
+		}
+		if result.Allowed {
+			t.Error("Expected request to be rejected")
+		}
+		if result.RetryAfter <= 0 || result.RetryAfter > window {
+			t.Errorf("Expected retry after to be within the window, got %v", result.RetryAfter)
+		}
+
+		time.Sleep(result.RetryAfter + 100*time.Millisecond)
+
+		result, err = storage.SlidingWindowLog(ctx, key, 3, window, 1)
+		if err != nil {
+			t.Fatalf("Failed to run sliding window log: %v", err)
+		}
+		if !result.Allowed {
+			t.Error("Expected request to be allowed after the window slid")
+		}
+	})
+
+	t.Run("Sliding window counter", func(t *testing.T) {
+		key := "sliding-counter-test"
+
+		for i := 0; i < 3; i++ {
+			result, err := storage.SlidingWindowCounter(ctx, key, 3, window, 1)
+			if err != nil {
+				t.Fatalf("Failed to run sliding window counter: %v", err)
+			}
+			if !result.Allowed {
+				t.Errorf("Expected request %d to be allowed", i+1)
+			}
+		}
+
+		result, err := storage.SlidingWindowCounter(ctx, key, 3, window, 1)
+		if err != nil {
+			t.Fatalf("Failed to run sliding window counter: %v", err)
+		}
+		if result.Allowed {
+			t.Error("Expected request to be rejected")
+		}
+
+		time.Sleep(2*window + 100*time.Millisecond)
+
+		result, err = storage.SlidingWindowCounter(ctx, key, 3, window, 1)
+		if err != nil {
+			t.Fatalf("Failed to run sliding window counter: %v", err)
+		}
+		if !result.Allowed {
+			t.Error("Expected request to be allowed after two windows")
+		}
+	})
+}
+
+func TestRedisStorage_GCRA(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := "gcra-test"
+	interval := 500 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		result, err := storage.GCRA(ctx, key, 2, interval, 1)
+		if err != nil {
+			t.Fatalf("Failed to run GCRA: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != int64(1-i) {
+			t.Errorf("Expected %d remaining requests, got %d", 1-i, result.Remaining)
+		}
+	}
+
+	result, err := storage.GCRA(ctx, key, 2, interval, 1)
+	if err != nil {
+		t.Fatalf("Failed to run GCRA: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be rejected")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > interval {
+		t.Errorf("Expected retry after to be within one interval, got %v", result.RetryAfter)
+	}
+
+	ttl, err := storage.client.PTTL(ctx, redisKey("gcra:", key)).Result()
+	if err != nil {
+		t.Fatalf("Failed to get TTL: %v", err)
+	}
+	if ttl <= 0 || ttl > 2*interval {
+		t.Errorf("Expected the arrival time to expire within the burst, got %v", ttl)
+	}
+
+	time.Sleep(result.RetryAfter + 50*time.Millisecond)
+
+	result, err = storage.GCRA(ctx, key, 2, interval, 1)
+	if err != nil {
+		t.Fatalf("Failed to run GCRA: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after the retry after")
+	}
+
+	// Intervals below the microsecond resolution of the script are rounded up
+	result, err = storage.GCRA(ctx, "gcra-short-interval", 2, 100*time.Nanosecond, 1)
+	if err != nil {
+		t.Fatalf("Failed to run GCRA with a sub-microsecond interval: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 1 {
+		t.Errorf("Expected the request to be allowed with 1 remaining, got %+v", result)
+	}
+}
+
+func TestRedisStorage_IncrementWindows(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := "windows-test"
+	windows := []Window{
+		{Limit: 3, Period: time.Second},
+		{Limit: 4, Period: time.Minute},
+	}
+	block := BlockPolicy{Duration: time.Second, Multiplier: 2, Decay: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		result, err := storage.IncrementWindows(ctx, key, windows, 1, block)
+		if err != nil {
+			t.Fatalf("Failed to increment windows: %v", err)
+		}
+		if result.Exceeded != -1 || result.Blocked != 0 {
+			t.Errorf("Expected request %d to be counted, got %+v", i+1, result)
+		}
+		if result.Counts[0].Count != int64(i+1) || result.Counts[1].Count != int64(i+1) {
+			t.Errorf("Expected both counts to be %d, got %+v", i+1, result.Counts)
+		}
+	}
+
+	// A request after the limit of the first window blocks the key
+	result, err := storage.IncrementWindows(ctx, key, windows, 1, block)
+	if err != nil {
+		t.Fatalf("Failed to increment windows: %v", err)
+	}
+	if result.Exceeded != 0 || result.Blocked != time.Second {
+		t.Errorf("Expected the first window to block the key for a second, got %+v", result)
+	}
+	if result.Counts[1].Count != 3 {
+		t.Errorf("Expected the rejected request not to be counted, got %d", result.Counts[1].Count)
+	}
+	if result.Counts[1].ResetAfter <= time.Second || result.Counts[1].ResetAfter > time.Minute {
+		t.Errorf("Expected the minute window to reset within a minute, got %v", result.Counts[1].ResetAfter)
+	}
+
+	result, err = storage.IncrementWindows(ctx, key, windows, 1, block)
+	if err != nil {
+		t.Fatalf("Failed to increment windows: %v", err)
+	}
+	if result.Blocked <= 0 || result.Blocked > time.Second || result.Counts != nil {
+		t.Errorf("Expected the key to remain blocked, got %+v", result)
+	}
+	if violations := storage.client.Get(ctx, redisKey("violations:", key)).Val(); violations != "1" {
+		t.Errorf("Expected a single violation, got %q", violations)
+	}
+
+	time.Sleep(result.Blocked + 50*time.Millisecond)
+
+	result, err = storage.IncrementWindows(ctx, key, windows, 1, block)
+	if err != nil {
+		t.Fatalf("Failed to increment windows: %v", err)
+	}
+	if result.Exceeded != -1 || result.Counts[0].Count != 1 || result.Counts[1].Count != 4 {
+		t.Errorf("Expected request to be counted in a new second, got %+v", result)
+	}
+
+	// The other windows only reject the request
+	result, err = storage.IncrementWindows(ctx, key, windows, 1, block)
+	if err != nil {
+		t.Fatalf("Failed to increment windows: %v", err)
+	}
+	if result.Exceeded != 1 || result.Blocked != 0 {
+		t.Errorf("Expected the minute window to be exceeded without a block, got %+v", result)
+	}
+}
+
+func TestRedisStorage_Quota(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := "quota-test"
+	expiresAt := time.Now().Add(time.Hour)
+
+	used, consumed, err := storage.ConsumeQuota(ctx, key, 3, 5, expiresAt)
+	if err != nil {
+		t.Fatalf("Failed to consume quota: %v", err)
+	}
+	if !consumed || used != 3 {
+		t.Errorf("Expected usage of 3 to be consumed, got %d (consumed %v)", used, consumed)
+	}
+
+	used, consumed, err = storage.ConsumeQuota(ctx, key, 3, 5, expiresAt)
+	if err != nil {
+		t.Fatalf("Failed to consume quota: %v", err)
+	}
+	if consumed || used != 3 {
+		t.Errorf("Expected usage over the limit not to be consumed, got %d (consumed %v)", used, consumed)
+	}
+
+	if used, _, err = storage.ConsumeQuota(ctx, key, -2, 5, expiresAt); err != nil || used != 1 {
+		t.Errorf("Expected top up to lower the usage to 1, got %d (%v)", used, err)
+	}
+
+	if used, err = storage.QuotaUsage(ctx, key); err != nil || used != 1 {
+		t.Errorf("Expected usage of 1, got %d (%v)", used, err)
+	}
+
+	ttl, err := storage.client.PTTL(ctx, redisKey("", key)).Result()
+	if err != nil {
+		t.Fatalf("Failed to get TTL: %v", err)
+	}
+	if ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected the quota to expire at the given time, got %v", ttl)
+	}
+
+	if used, err = storage.QuotaUsage(ctx, "missing-quota"); err != nil || used != 0 {
+		t.Errorf("Expected no usage for a missing quota, got %d (%v)", used, err)
+	}
+}
+
+func TestRedisStorage_Violations(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := "violations-test"
+
+	for i := int64(1); i <= 3; i++ {
+		violations, err := storage.AddViolation(ctx, key, time.Minute)
+		if err != nil {
+			t.Fatalf("Failed to add violation: %v", err)
+		}
+		if violations != i {
+			t.Errorf("Expected %d violations, got %d", i, violations)
+		}
+	}
+
+	// Resetting the key, as the limiter does before blocking it, keeps the history
+	if err := storage.Reset(ctx, key); err != nil {
+		t.Fatalf("Failed to reset key: %v", err)
+	}
+	if violations, _ := storage.AddViolation(ctx, key, 50*time.Millisecond); violations != 4 {
+		t.Errorf("Expected the history to survive a reset, got %d violations", violations)
+	}
+
+	// Every violation restarts the decay
+	time.Sleep(100 * time.Millisecond)
+	if violations, _ := storage.AddViolation(ctx, key, time.Minute); violations != 1 {
+		t.Errorf("Expected the history to be forgotten after the decay, got %d violations", violations)
+	}
+}
+
+func TestRedisStorage_FixedWindow(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	block := BlockPolicy{Duration: time.Minute}
+
+	t.Run("Counts and blocks in one call", func(t *testing.T) {
+		key := "fixed-test"
+		for i := int64(1); i <= 3; i++ {
+			result, err := storage.FixedWindow(ctx, key, 3, time.Second, 1, block)
+			if err != nil {
+				t.Fatalf("Failed to check fixed window: %v", err)
+			}
+			if !result.Allowed || result.Remaining != 3-i {
+				t.Errorf("Request %d: expected to be allowed with %d remaining, got %+v", i, 3-i, result)
+			}
+			if result.ResetAfter <= 0 || result.ResetAfter > time.Second {
+				t.Errorf("Request %d: expected to reset within the window, got %v", i, result.ResetAfter)
+			}
+		}
+
+		result, err := storage.FixedWindow(ctx, key, 3, time.Second, 1, block)
+		if err != nil {
+			t.Fatalf("Failed to check fixed window: %v", err)
+		}
+		if result.Allowed || result.RetryAfter != time.Minute {
+			t.Errorf("Expected the key to be blocked for a minute, got %+v", result)
+		}
+
+		result, _ = storage.FixedWindow(ctx, key, 3, time.Second, 1, block)
+		if result.Allowed || result.RetryAfter <= 59*time.Second || result.RetryAfter > time.Minute {
+			t.Errorf("Expected the remaining block to be reported, got %+v", result)
+		}
+		if blocked, _ := storage.IsBlocked(ctx, key); !blocked {
+			t.Error("Expected the block to be visible to IsBlocked")
+		}
+		if count := storage.client.Exists(ctx, redisKey("", key)).Val(); count != 0 {
+			t.Error("Expected the counter to be reset when blocking")
+		}
+	})
+
+	t.Run("Requests that do not fit are rejected without being counted", func(t *testing.T) {
+		key := "fixed-cost-test"
+
+		storage.FixedWindow(ctx, key, 10, time.Second, 8, block)
+		result, err := storage.FixedWindow(ctx, key, 10, time.Second, 3, block)
+		if err != nil {
+			t.Fatalf("Failed to check fixed window: %v", err)
+		}
+		if result.Allowed || result.Remaining != 2 || result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+			t.Errorf("Expected the request to be rejected until the window resets, got %+v", result)
+		}
+
+		// The key is not blocked and its allowance is intact
+		if result, _ = storage.FixedWindow(ctx, key, 10, time.Second, 2, block); !result.Allowed || result.Remaining != 0 {
+			t.Errorf("Expected the remaining cost to be allowed, got %+v", result)
+		}
+		if result, _ = storage.FixedWindow(ctx, key, 10, time.Second, 1, block); result.Allowed || result.RetryAfter != time.Minute {
+			t.Errorf("Expected the key at its limit to be blocked, got %+v", result)
+		}
+	})
+
+	t.Run("Blocks escalate with penalties", func(t *testing.T) {
+		key := "fixed-penalty-test"
+		escalating := BlockPolicy{Duration: time.Minute, Multiplier: 3, MaxDuration: 5 * time.Minute, Decay: time.Hour}
+
+		for _, expected := range []time.Duration{time.Minute, 3 * time.Minute, 5 * time.Minute} {
+			storage.client.Del(ctx, redisKey("blocked:", key))
+			result, err := storage.FixedWindow(ctx, key, 0, time.Second, 1, escalating)
+			if err != nil {
+				t.Fatalf("Failed to check fixed window: %v", err)
+			}
+			if result.RetryAfter != expected {
+				t.Errorf("Expected a block of %v, got %v", expected, result.RetryAfter)
+			}
+		}
+		if ttl := storage.client.PTTL(ctx, redisKey("violations:", key)).Val(); ttl <= 59*time.Minute {
+			t.Errorf("Expected the violations to decay in an hour, got %v", ttl)
+		}
+	})
+
+	t.Run("Concurrent requests never exceed the limit", func(t *testing.T) {
+		key := "fixed-concurrent-test"
+		var allowed, blocked atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := storage.FixedWindow(ctx, key, 10, time.Minute, 1, block)
+				if err != nil {
+					t.Errorf("Failed to check fixed window: %v", err)
+					return
+				}
+				if result.Allowed {
+					allowed.Add(1)
+				} else {
+					blocked.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if allowed.Load() != 10 || blocked.Load() != 40 {
+			t.Errorf("Expected 10 allowed and 40 blocked requests, got %d and %d", allowed.Load(), blocked.Load())
+		}
+		if violations := storage.client.Exists(ctx, redisKey("violations:", key)).Val(); violations != 0 {
+			t.Error("Expected no violations to be recorded without penalties")
+		}
+	})
+}
+
+func TestRedisStorage_SustainedTraffic(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	window := 200 * time.Millisecond
+	interval := 20 * time.Millisecond
+
+	increments := map[string]func(key string) (int64, error){
+		"Increment": func(key string) (int64, error) {
+			return storage.Increment(ctx, key, window)
+		},
+		"IncrementBy": func(key string) (int64, error) {
+			return storage.IncrementBy(ctx, key, 1, window)
+		},
+	}
+
+	for name, increment := range increments {
+		t.Run(name, func(t *testing.T) {
+			key := "sustained-" + name
+
+			// A client sending steadily must not keep its window alive, the
+			// counter restarts once the first request of the window expires
+			var highest int64
+			resets := 0
+			previous := int64(0)
+			for deadline := time.Now().Add(4 * window); time.Now().Before(deadline); time.Sleep(interval) {
+				count, err := increment(key)
+				if err != nil {
+					t.Fatalf("Failed to increment: %v", err)
+				}
+				if count < previous {
+					resets++
+				}
+				if count > highest {
+					highest = count
+				}
+				previous = count
+
+				if ttl := storage.client.PTTL(ctx, redisKey("", key)).Val(); ttl <= 0 || ttl > window {
+					t.Fatalf("Expected the key to expire within the window, got %v", ttl)
+				}
+			}
+
+			if limit := int64(window/interval) + 1; highest > limit {
+				t.Errorf("Expected at most %d requests per window, got %d", limit, highest)
+			}
+			if resets < 2 {
+				t.Errorf("Expected the counter to restart every window, restarted %d times", resets)
+			}
+		})
+	}
+
+	t.Run("Expiration is only set by the first increment", func(t *testing.T) {
+		key := "sustained-ttl"
+		storage.Increment(ctx, key, time.Second)
+		time.Sleep(100 * time.Millisecond)
+		storage.Increment(ctx, key, time.Second)
+
+		if ttl := storage.client.PTTL(ctx, redisKey("", key)).Val(); ttl > 950*time.Millisecond {
+			t.Errorf("Expected the second increment not to re-arm the expiration, got %v", ttl)
+		}
+	})
+}
+
+func TestRedisStorage_Cost(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	count, err := storage.IncrementBy(ctx, "cost-counter", 4, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to increment by cost: %v", err)
+	}
+	if count, _ = storage.IncrementBy(ctx, "cost-counter", 3, time.Minute); count != 7 {
+		t.Errorf("Expected count of 7, got %d", count)
+	}
+
+	algorithms := map[string]func(key string, cost int64) (Result, error){
+		"token bucket": func(key string, cost int64) (Result, error) {
+			return storage.TakeToken(ctx, key, 5, 0.1, cost)
+		},
+		"sliding window log": func(key string, cost int64) (Result, error) {
+			return storage.SlidingWindowLog(ctx, key, 5, time.Minute, cost)
+		},
+		"sliding window counter": func(key string, cost int64) (Result, error) {
+			return storage.SlidingWindowCounter(ctx, key, 5, time.Minute, cost)
+		},
+		"GCRA": func(key string, cost int64) (Result, error) {
+			return storage.GCRA(ctx, key, 5, 10*time.Second, cost)
+		},
+	}
+
+	for name, run := range algorithms {
+		key := "cost-" + name
+		result, err := run(key, 4)
+		if err != nil {
+			t.Fatalf("%s: failed to run: %v", name, err)
+		}
+		if !result.Allowed || result.Remaining != 1 {
+			t.Errorf("%s: expected request costing 4 to be allowed with 1 remaining, got %+v", name, result)
+		}
+
+		result, err = run(key, 2)
+		if err != nil {
+			t.Fatalf("%s: failed to run: %v", name, err)
+		}
+		if result.Allowed || result.RetryAfter <= 0 {
+			t.Errorf("%s: expected request costing 2 to be rejected, got %+v", name, result)
+		}
+	}
+}
+
 func TestRedisStorage_BlockExpiration(t *testing.T) {
 	storage, cleanup := setupTestRedis(t)
 	defer cleanup()
@@ -279,3 +863,83 @@ func TestRedisStorage_BlockExpiration(t *testing.T) {
 		t.Error("Expected key to be unblocked after expiration")
 	}
 }
+
+func TestRedisStorage_HashTags(t *testing.T) {
+	storage, cleanup := setupTestRedis(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// Keys may come from the client, braces included
+	for _, key := range []string{"ratelimit:ip:10.0.0.1", "}token", "{token}", "to{k}en", ""} {
+		storage.client.FlushDB(ctx)
+
+		// Counted before the fixed window blocks the key
+		storage.IncrementWindows(ctx, key, []Window{{Limit: 10, Period: time.Second}, {Limit: 100, Period: time.Minute}}, 1, BlockPolicy{Duration: time.Minute})
+		storage.FixedWindow(ctx, key, 0, time.Minute, 1, BlockPolicy{Duration: time.Minute, Multiplier: 2, Decay: time.Hour})
+		storage.Increment(ctx, key, time.Minute)
+		storage.TakeToken(ctx, key, 10, 1, 1)
+		storage.SlidingWindowLog(ctx, key, 10, time.Minute, 1)
+		storage.SlidingWindowCounter(ctx, key, 10, time.Minute, 1)
+		storage.GCRA(ctx, key, 10, time.Second, 1)
+
+		keys := storage.client.Keys(ctx, "*").Val()
+		if len(keys) != 9 {
+			t.Errorf("%q: expected 9 keys, got %v", key, keys)
+		}
+
+		// Redis Cluster hashes the part between the first { and the next }, when
+		// it is not empty
+		tags := make(map[string]bool)
+		for _, redisKey := range keys {
+			start := strings.Index(redisKey, "{")
+			end := strings.Index(redisKey[start+1:], "}")
+			if start < 0 || end <= 0 {
+				t.Errorf("%q: expected %q to have a hash tag", key, redisKey)
+				continue
+			}
+			tags[redisKey[start+1:start+1+end]] = true
+		}
+		if len(tags) != 1 {
+			t.Errorf("%q: expected the keys to share a single hash tag, got %v", key, tags)
+		}
+
+		if err := storage.Reset(ctx, key); err != nil {
+			t.Fatalf("%q: failed to reset: %v", key, err)
+		}
+		if exists := storage.client.Exists(ctx, redisKey("blocked:", key)).Val(); exists != 0 {
+			t.Errorf("%q: expected the block to be reset", key)
+		}
+	}
+}
+
+func TestNewRedisStorageFromClient(t *testing.T) {
+	_ = godotenv.Load("../../.env")
+
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:    []string{host + ":6379"},
+		Password: os.Getenv("REDIS_PASSWORD"),
+	})
+	storage, err := NewRedisStorageFromClient(client)
+	if err != nil {
+		t.Fatalf("Failed to create Redis storage: %v", err)
+	}
+	defer storage.Close()
+
+	ctx := context.Background()
+	defer storage.client.Del(ctx, redisKey("", "universal-test"))
+	if count, err := storage.Increment(ctx, "universal-test", time.Minute); err != nil || count != 1 {
+		t.Errorf("Expected count 1, got %d and %v", count, err)
+	}
+
+	unreachable := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{"127.0.0.1:1"}})
+	defer unreachable.Close()
+	if _, err := NewRedisStorageFromClient(unreachable); err == nil {
+		t.Error("Expected an error for an unreachable Redis")
+	}
+}
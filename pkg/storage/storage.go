@@ -7,8 +7,12 @@ import (
 
 // Storage defines the interface for rate limiter storage implementations
 type Storage interface {
-	// Increment increments the counter for a key and returns the current count
+	// Increment increments the counter for a key and returns the current count. The
+	// expiration is only set by the first increment, starting a fixed window
 	Increment(ctx context.Context, key string, expiration time.Duration) (int64, error)
+
+	// IncrementBy adds amount to the counter for a key and returns the current count
+	IncrementBy(ctx context.Context, key string, amount int64, expiration time.Duration) (int64, error)
 	
 	// IsBlocked checks if a key is currently blocked
 	IsBlocked(ctx context.Context, key string) (bool, error)
@@ -22,3 +26,136 @@ type Storage interface {
 	// Close closes the storage connection
 	Close() error
 }
+
+// Result holds the outcome of an algorithm evaluated by the storage
+type Result struct {
+	// Allowed reports whether the request fits in the limit
+	Allowed bool
+
+	// Remaining is the cost still available for the key
+	Remaining int64
+
+	// RetryAfter is how long the client has to wait before a request is allowed again
+	RetryAfter time.Duration
+
+	// ResetAfter is how long it takes for the key to be back to its full allowance
+	ResetAfter time.Duration
+}
+
+// The algorithm capabilities take the cost of the request, the number of requests
+// it counts as. A request is rejected when its whole cost does not fit in the limit
+
+// TokenBucketStorage is implemented by storages that support the token bucket algorithm
+type TokenBucketStorage interface {
+	// TakeToken refills the bucket of a key at rate tokens per second, up to capacity,
+	// and takes cost tokens from it when available
+	TakeToken(ctx context.Context, key string, capacity int64, rate float64, cost int64) (Result, error)
+}
+
+// SlidingWindowStorage is implemented by storages that support the sliding window algorithms
+type SlidingWindowStorage interface {
+	// SlidingWindowLog keeps the timestamp of every allowed request of a key and
+	// counts the ones that happened within the window
+	SlidingWindowLog(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error)
+
+	// SlidingWindowCounter estimates the requests of a key within the window from
+	// the current fixed window count and the weighted count of the previous one
+	SlidingWindowCounter(ctx context.Context, key string, limit int64, window time.Duration, cost int64) (Result, error)
+}
+
+// GCRAStorage is implemented by storages that support the generic cell rate algorithm
+type GCRAStorage interface {
+	// GCRA stores a single theoretical arrival time per key and allows a request when
+	// it is at most burst emission intervals ahead of now, a request taking cost intervals
+	GCRA(ctx context.Context, key string, burst int64, interval time.Duration, cost int64) (Result, error)
+}
+
+// BlockPolicy is how a key exceeding its fixed window is blocked. Penalties are
+// disabled when Multiplier is zero
+type BlockPolicy struct {
+	// Duration is the block of the first violation
+	Duration time.Duration
+
+	// Multiplier is applied to Duration for every previous violation within
+	// Decay, up to MaxDuration when it is not zero
+	Multiplier  float64
+	MaxDuration time.Duration
+	Decay       time.Duration
+}
+
+// FixedWindowStorage is implemented by storages that check and count a fixed
+// window in one atomic operation, instead of the separate IsBlocked, IncrementBy,
+// Reset and Block calls that race under concurrency
+type FixedWindowStorage interface {
+	// FixedWindow reports the remaining block of a key when it is blocked. Otherwise
+	// it adds cost to the counter of the key in the window when the count stays
+	// within limit. A request that does not fit is rejected without being counted
+	// and, when the key had already reached limit, the counter is reset, a violation
+	// is recorded when penalties are enabled and the key is blocked according to block
+	FixedWindow(ctx context.Context, key string, limit int64, window time.Duration, cost int64, block BlockPolicy) (Result, error)
+}
+
+// BlockTTLStorage is implemented by storages that can tell how long a key remains blocked
+type BlockTTLStorage interface {
+	// BlockTTL returns the remaining block time of a key, zero when it is not blocked
+	// and a negative duration when it is blocked without expiration
+	BlockTTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+// Window is a limit over a fixed window of time
+type Window struct {
+	Limit  int64
+	Period time.Duration
+}
+
+// WindowCount is the state of a key in one of its windows
+type WindowCount struct {
+	Count      int64
+	ResetAfter time.Duration
+}
+
+// WindowsResult is the outcome of a request counted in several windows
+type WindowsResult struct {
+	// Counts is the state of the key in every window, nil when it is blocked
+	Counts []WindowCount
+
+	// Exceeded is the index of the first window the request would exceed, or -1
+	// when the request was counted
+	Exceeded int
+
+	// Blocked is the remaining block of the key when it was already blocked or
+	// got blocked by the request, zero otherwise
+	Blocked time.Duration
+}
+
+// MultiWindowStorage is implemented by storages that can count a key in several
+// fixed windows atomically
+type MultiWindowStorage interface {
+	// IncrementWindows reports the remaining block of a key when it is blocked.
+	// Otherwise it adds cost to the counters of the key in every window, unless one
+	// of them would exceed its limit. A key that had already reached the limit of
+	// the first window is blocked according to block, with a violation recorded
+	// when penalties are enabled, while the other windows only reject the request
+	IncrementWindows(ctx context.Context, key string, windows []Window, cost int64, block BlockPolicy) (WindowsResult, error)
+}
+
+// QuotaStorage is implemented by storages that keep usage counters expiring at a
+// fixed time, for quotas aligned to calendar periods
+type QuotaStorage interface {
+	// ConsumeQuota adds amount to the usage of a key unless the usage would exceed
+	// limit, and makes the key expire at expiresAt. Negative amounts are always
+	// applied, giving quota back. It returns the usage and whether it changed
+	ConsumeQuota(ctx context.Context, key string, amount, limit int64, expiresAt time.Time) (int64, bool, error)
+
+	// QuotaUsage returns the usage of a key, zero when it has none
+	QuotaUsage(ctx context.Context, key string) (int64, error)
+}
+
+// ViolationStorage is implemented by storages that keep the violation history of
+// keys, used to escalate the blocks of repeat offenders. The history is not
+// cleared by Reset
+type ViolationStorage interface {
+	// AddViolation records a violation of a key and returns the number of its
+	// violations. The history is forgotten once decay passes without a violation
+	AddViolation(ctx context.Context, key string, decay time.Duration) (int64, error)
+}
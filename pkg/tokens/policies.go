@@ -0,0 +1,231 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrUnknownTier is returned when a token is assigned to a tier that has no policy
+var ErrUnknownTier = errors.New("unknown tier")
+
+// Policy is the rate limit of a token. Zero fields fall back to the limiter
+// configuration
+type Policy struct {
+	Limit         int
+	Window        time.Duration
+	BlockDuration time.Duration
+}
+
+// Tiers maps plan names, such as free, pro or enterprise, to the policy shared
+// by their tokens
+type Tiers map[string]Policy
+
+// PolicySource defines the interface for the sources of per-token policies
+type PolicySource interface {
+	// Policy returns the policy of a token and whether it has one
+	Policy(ctx context.Context, token string) (Policy, bool, error)
+}
+
+// StaticPolicies assigns tokens to tiers, or to their own policy, in memory.
+// Every token with a policy is also a valid token, so it can be used as a Registry
+type StaticPolicies struct {
+	tiers     Tiers
+	tokens    map[string]string
+	overrides map[string]Policy
+	mutex     sync.RWMutex
+}
+
+// NewStaticPolicies creates policies from the tiers and the tier of each token
+func NewStaticPolicies(tiers Tiers, tokens map[string]string) *StaticPolicies {
+	s := &StaticPolicies{
+		tiers:     Tiers{},
+		tokens:    make(map[string]string),
+		overrides: make(map[string]Policy),
+	}
+	for name, policy := range tiers {
+		s.tiers[name] = policy
+	}
+	for token, tier := range tokens {
+		s.tokens[token] = tier
+	}
+	return s
+}
+
+func (s *StaticPolicies) Policy(ctx context.Context, token string) (Policy, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if policy, exists := s.overrides[token]; exists {
+		return policy, true, nil
+	}
+
+	tier, exists := s.tokens[token]
+	if !exists {
+		return Policy{}, false, nil
+	}
+
+	policy, exists := s.tiers[tier]
+	if !exists {
+		return Policy{}, false, fmt.Errorf("token assigned to %w %q", ErrUnknownTier, tier)
+	}
+	return policy, true, nil
+}
+
+func (s *StaticPolicies) Exists(ctx context.Context, token string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, assigned := s.tokens[token]
+	_, overridden := s.overrides[token]
+	return assigned || overridden, nil
+}
+
+// Assign moves a token to a tier
+func (s *StaticPolicies) Assign(token, tier string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.tiers[tier]; !exists {
+		return fmt.Errorf("%w %q", ErrUnknownTier, tier)
+	}
+	s.tokens[token] = tier
+	return nil
+}
+
+// Override gives a token its own policy, taking precedence over its tier
+func (s *StaticPolicies) Override(token string, policy Policy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.overrides[token] = policy
+}
+
+// policyFile is the JSON representation of a Policy, with durations such as "1m"
+type policyFile struct {
+	Limit         int    `json:"limit"`
+	Window        string `json:"window"`
+	BlockDuration string `json:"block_duration"`
+}
+
+// LoadPolicyFile reads tiers and token assignments from a JSON file:
+//
+//	{
+//	  "tiers": {
+//	    "free": {"limit": 10, "window": "1s", "block_duration": "5m"},
+//	    "pro": {"limit": 100, "window": "1s"}
+//	  },
+//	  "tokens": {"abc123": "free", "def456": "pro"},
+//	  "overrides": {"ghi789": {"limit": 1000}}
+//	}
+func LoadPolicyFile(path string) (*StaticPolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	var file struct {
+		Tiers     map[string]policyFile `json:"tiers"`
+		Tokens    map[string]string     `json:"tokens"`
+		Overrides map[string]policyFile `json:"overrides"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file: %v", err)
+	}
+
+	tiers := Tiers{}
+	for name, tier := range file.Tiers {
+		policy, err := tier.policy()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tier %q: %v", name, err)
+		}
+		tiers[name] = policy
+	}
+
+	for token, tier := range file.Tokens {
+		if _, exists := tiers[tier]; !exists {
+			return nil, fmt.Errorf("token %q assigned to unknown tier %q", token, tier)
+		}
+	}
+
+	policies := NewStaticPolicies(tiers, file.Tokens)
+	for token, override := range file.Overrides {
+		policy, err := override.policy()
+		if err != nil {
+			return nil, fmt.Errorf("invalid override for token %q: %v", token, err)
+		}
+		policies.Override(token, policy)
+	}
+
+	return policies, nil
+}
+
+func (p policyFile) policy() (Policy, error) {
+	policy := Policy{Limit: p.Limit}
+
+	var err error
+	if p.Window != "" {
+		if policy.Window, err = time.ParseDuration(p.Window); err != nil {
+			return Policy{}, fmt.Errorf("invalid window: %v", err)
+		}
+	}
+	if p.BlockDuration != "" {
+		if policy.BlockDuration, err = time.ParseDuration(p.BlockDuration); err != nil {
+			return Policy{}, fmt.Errorf("invalid block duration: %v", err)
+		}
+	}
+	return policy, nil
+}
+
+// RedisPolicies reads the tier of each token from a Redis hash, so a customer
+// can be moved to another tier with HSET without a redeploy. Every token in the
+// hash is also a valid token, so it can be used as a Registry
+type RedisPolicies struct {
+	client redis.Cmdable
+	key    string
+	tiers  Tiers
+}
+
+func NewRedisPolicies(client redis.Cmdable, key string, tiers Tiers) *RedisPolicies {
+	return &RedisPolicies{client: client, key: key, tiers: tiers}
+}
+
+func (r *RedisPolicies) Policy(ctx context.Context, token string) (Policy, bool, error) {
+	tier, err := r.client.HGet(ctx, r.key, token).Result()
+	if err == redis.Nil {
+		return Policy{}, false, nil
+	} else if err != nil {
+		return Policy{}, false, fmt.Errorf("failed to get token tier: %v", err)
+	}
+
+	policy, exists := r.tiers[tier]
+	if !exists {
+		return Policy{}, false, fmt.Errorf("token assigned to %w %q", ErrUnknownTier, tier)
+	}
+	return policy, true, nil
+}
+
+func (r *RedisPolicies) Exists(ctx context.Context, token string) (bool, error) {
+	exists, err := r.client.HExists(ctx, r.key, token).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check token: %v", err)
+	}
+	return exists, nil
+}
+
+// Assign moves a token to a tier
+func (r *RedisPolicies) Assign(ctx context.Context, token, tier string) error {
+	if _, exists := r.tiers[tier]; !exists {
+		return fmt.Errorf("%w %q", ErrUnknownTier, tier)
+	}
+	if err := r.client.HSet(ctx, r.key, token, tier).Err(); err != nil {
+		return fmt.Errorf("failed to assign token tier: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/joho/godotenv"
+)
+
+var testTiers = Tiers{
+	"free": {Limit: 10, Window: time.Second, BlockDuration: 5 * time.Minute},
+	"pro":  {Limit: 100, Window: time.Second},
+}
+
+func TestStaticPolicies(t *testing.T) {
+	ctx := context.Background()
+	policies := NewStaticPolicies(testTiers, map[string]string{"abc123": "free"})
+
+	policy, found, err := policies.Policy(ctx, "abc123")
+	if err != nil || !found || policy.Limit != 10 {
+		t.Errorf("Expected free tier policy, got %+v, %v and error %v", policy, found, err)
+	}
+
+	if _, found, _ := policies.Policy(ctx, "unknown"); found {
+		t.Error("Expected no policy for unknown token")
+	}
+
+	t.Run("Upgrade token tier", func(t *testing.T) {
+		if err := policies.Assign("abc123", "pro"); err != nil {
+			t.Fatalf("Failed to assign tier: %v", err)
+		}
+		if policy, _, _ := policies.Policy(ctx, "abc123"); policy.Limit != 100 {
+			t.Errorf("Expected pro tier limit 100, got %d", policy.Limit)
+		}
+		if err := policies.Assign("abc123", "platinum"); err == nil {
+			t.Error("Expected error for unknown tier")
+		}
+	})
+
+	t.Run("Override takes precedence over the tier", func(t *testing.T) {
+		policies.Override("abc123", Policy{Limit: 5})
+		if policy, _, _ := policies.Policy(ctx, "abc123"); policy.Limit != 5 {
+			t.Errorf("Expected overridden limit 5, got %d", policy.Limit)
+		}
+	})
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "policies.json")
+	content := `{
+		"tiers": {
+			"free": {"limit": 10, "window": "1s", "block_duration": "5m"},
+			"enterprise": {"limit": 5000, "window": "1m"}
+		},
+		"tokens": {"abc123": "free", "def456": "enterprise"},
+		"overrides": {"ghi789": {"limit": 42}}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write policy file: %v", err)
+	}
+
+	policies, err := LoadPolicyFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load policy file: %v", err)
+	}
+
+	expected := map[string]Policy{
+		"abc123": {Limit: 10, Window: time.Second, BlockDuration: 5 * time.Minute},
+		"def456": {Limit: 5000, Window: time.Minute},
+		"ghi789": {Limit: 42},
+	}
+	for token, want := range expected {
+		policy, found, err := policies.Policy(ctx, token)
+		if err != nil || !found || policy != want {
+			t.Errorf("Expected policy %+v for %s, got %+v, %v and error %v", want, token, policy, found, err)
+		}
+		if exists, _ := policies.Exists(ctx, token); !exists {
+			t.Errorf("Expected token %s to exist", token)
+		}
+	}
+
+	t.Run("Unknown tier", func(t *testing.T) {
+		os.WriteFile(path, []byte(`{"tiers": {}, "tokens": {"abc123": "free"}}`), 0o600)
+		if _, err := LoadPolicyFile(path); err == nil {
+			t.Error("Expected error for token assigned to unknown tier")
+		}
+	})
+
+	t.Run("Invalid duration", func(t *testing.T) {
+		os.WriteFile(path, []byte(`{"tiers": {"free": {"limit": 1, "window": "soon"}}}`), 0o600)
+		if _, err := LoadPolicyFile(path); err == nil {
+			t.Error("Expected error for invalid window")
+		}
+	})
+}
+
+func TestRedisPolicies(t *testing.T) {
+	_ = godotenv.Load("../../.env")
+
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	client := redis.NewClient(&redis.Options{Addr: host + ":6379", Password: os.Getenv("REDIS_PASSWORD")})
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	defer client.Del(ctx, "test:token-tiers")
+
+	policies := NewRedisPolicies(client, "test:token-tiers", testTiers)
+
+	if _, found, err := policies.Policy(ctx, "abc123"); err != nil || found {
+		t.Errorf("Expected no policy for unassigned token, got %v and error %v", found, err)
+	}
+
+	if err := policies.Assign(ctx, "abc123", "pro"); err != nil {
+		t.Fatalf("Failed to assign tier: %v", err)
+	}
+
+	policy, found, err := policies.Policy(ctx, "abc123")
+	if err != nil || !found || policy.Limit != 100 {
+		t.Errorf("Expected pro tier policy, got %+v, %v and error %v", policy, found, err)
+	}
+
+	if exists, _ := policies.Exists(ctx, "abc123"); !exists {
+		t.Error("Expected assigned token to exist")
+	}
+
+	client.HSet(ctx, "test:token-tiers", "def456", "platinum")
+	if _, _, err := policies.Policy(ctx, "def456"); !errors.Is(err, ErrUnknownTier) {
+		t.Errorf("Expected ErrUnknownTier, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package tokens
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Registry defines the interface for the sources of valid API tokens
+type Registry interface {
+	// Exists reports whether a token is known
+	Exists(ctx context.Context, token string) (bool, error)
+}
+
+// MemoryRegistry keeps the valid tokens in memory and can be edited at runtime
+type MemoryRegistry struct {
+	tokens map[string]struct{}
+	mutex  sync.RWMutex
+}
+
+func NewMemoryRegistry(tokens ...string) *MemoryRegistry {
+	m := &MemoryRegistry{tokens: make(map[string]struct{})}
+	m.Add(tokens...)
+	return m
+}
+
+func (m *MemoryRegistry) Exists(ctx context.Context, token string) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	_, exists := m.tokens[token]
+	return exists, nil
+}
+
+// Add registers tokens
+func (m *MemoryRegistry) Add(tokens ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, token := range tokens {
+		m.tokens[token] = struct{}{}
+	}
+}
+
+// Remove unregisters tokens
+func (m *MemoryRegistry) Remove(tokens ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, token := range tokens {
+		delete(m.tokens, token)
+	}
+}
+
+// replace swaps every token at once
+func (m *MemoryRegistry) replace(tokens map[string]struct{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.tokens = tokens
+}
+
+// FileRegistry reads the valid tokens from a file with one token per line.
+// Blank lines and lines starting with # are ignored
+type FileRegistry struct {
+	*MemoryRegistry
+	path string
+}
+
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	f := &FileRegistry{MemoryRegistry: NewMemoryRegistry(), path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the file again, keeping the current tokens if it fails
+func (f *FileRegistry) Reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open token file: %v", err)
+	}
+	defer file.Close()
+
+	tokens := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	f.replace(tokens)
+	return nil
+}
+
+// RedisRegistry checks tokens against a Redis set, so they can be managed with
+// SADD and SREM without restarting the service
+type RedisRegistry struct {
+	client redis.Cmdable
+	key    string
+}
+
+func NewRedisRegistry(client redis.Cmdable, key string) *RedisRegistry {
+	return &RedisRegistry{client: client, key: key}
+}
+
+func (r *RedisRegistry) Exists(ctx context.Context, token string) (bool, error) {
+	exists, err := r.client.SIsMember(ctx, r.key, token).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check token: %v", err)
+	}
+	return exists, nil
+}
+
+// Add registers tokens in the set
+func (r *RedisRegistry) Add(ctx context.Context, tokens ...string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	if err := r.client.SAdd(ctx, r.key, toInterfaces(tokens)...).Err(); err != nil {
+		return fmt.Errorf("failed to add tokens: %v", err)
+	}
+	return nil
+}
+
+// Remove unregisters tokens from the set
+func (r *RedisRegistry) Remove(ctx context.Context, tokens ...string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	if err := r.client.SRem(ctx, r.key, toInterfaces(tokens)...).Err(); err != nil {
+		return fmt.Errorf("failed to remove tokens: %v", err)
+	}
+	return nil
+}
+
+func toInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
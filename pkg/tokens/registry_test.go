@@ -0,0 +1,122 @@
+package tokens
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/joho/godotenv"
+)
+
+func TestMemoryRegistry(t *testing.T) {
+	ctx := context.Background()
+	registry := NewMemoryRegistry("abc123")
+
+	if exists, _ := registry.Exists(ctx, "abc123"); !exists {
+		t.Error("Expected token to exist")
+	}
+	if exists, _ := registry.Exists(ctx, "unknown"); exists {
+		t.Error("Expected unknown token not to exist")
+	}
+
+	registry.Add("def456")
+	registry.Remove("abc123")
+
+	if exists, _ := registry.Exists(ctx, "def456"); !exists {
+		t.Error("Expected added token to exist")
+	}
+	if exists, _ := registry.Exists(ctx, "abc123"); exists {
+		t.Error("Expected removed token not to exist")
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.txt")
+	if err := os.WriteFile(path, []byte("# partners\nabc123\n\n  def456  \n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	registry, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("Failed to create file registry: %v", err)
+	}
+
+	for _, token := range []string{"abc123", "def456"} {
+		if exists, _ := registry.Exists(ctx, token); !exists {
+			t.Errorf("Expected token %s to exist", token)
+		}
+	}
+	if exists, _ := registry.Exists(ctx, "# partners"); exists {
+		t.Error("Expected comments to be ignored")
+	}
+
+	t.Run("Reload", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("ghi789\n"), 0o600); err != nil {
+			t.Fatalf("Failed to write token file: %v", err)
+		}
+		if err := registry.Reload(); err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+
+		if exists, _ := registry.Exists(ctx, "abc123"); exists {
+			t.Error("Expected token removed from the file not to exist")
+		}
+		if exists, _ := registry.Exists(ctx, "ghi789"); !exists {
+			t.Error("Expected token added to the file to exist")
+		}
+	})
+
+	t.Run("Failed reload keeps the tokens", func(t *testing.T) {
+		os.Remove(path)
+		if err := registry.Reload(); err == nil {
+			t.Error("Expected error for missing file")
+		}
+		if exists, _ := registry.Exists(ctx, "ghi789"); !exists {
+			t.Error("Expected tokens to be kept")
+		}
+	})
+}
+
+func TestRedisRegistry(t *testing.T) {
+	_ = godotenv.Load("../../.env")
+
+	host := os.Getenv("REDIS_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	client := redis.NewClient(&redis.Options{Addr: host + ":6379", Password: os.Getenv("REDIS_PASSWORD")})
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatalf("Failed to connect to Redis: %v", err)
+	}
+	defer client.Del(ctx, "test:tokens")
+
+	registry := NewRedisRegistry(client, "test:tokens")
+	if err := registry.Add(ctx, "abc123", "def456"); err != nil {
+		t.Fatalf("Failed to add tokens: %v", err)
+	}
+	if err := registry.Remove(ctx, "def456"); err != nil {
+		t.Fatalf("Failed to remove token: %v", err)
+	}
+
+	exists, err := registry.Exists(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("Failed to check token: %v", err)
+	}
+	if !exists {
+		t.Error("Expected token to exist")
+	}
+
+	exists, err = registry.Exists(ctx, "def456")
+	if err != nil {
+		t.Fatalf("Failed to check token: %v", err)
+	}
+	if exists {
+		t.Error("Expected removed token not to exist")
+	}
+}